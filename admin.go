@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/google/uuid"
+)
+
+// adminLocation is the admin api representation of a supported location
+type adminLocation struct {
+	Key         string     `json:"key"`
+	Name        string     `json:"name"`
+	Subscribers int        `json:"subscribers"`
+	LastUpdated *time.Time `json:"lastUpdated"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	NextRun     *time.Time `json:"nextRun"`
+	// GenerationLatencyMs is how long it took to generate the latest summary in milliseconds
+	GenerationLatencyMs int64      `json:"generationLatencyMs"`
+	LastPushAt          *time.Time `json:"lastPushAt"`
+	// PushesSucceeded and PushesFailed count the deliveries of summaries over every channel since the server started
+	PushesSucceeded int `json:"pushesSucceeded"`
+	PushesFailed    int `json:"pushesFailed"`
+}
+
+// adminDashboardData stores template data for admin/dashboard.html
+type adminDashboardData struct {
+	Locations []adminDashboardLocation
+	Now       time.Time
+}
+
+// adminDashboardLocation is a row of the location table on the admin dashboard
+type adminDashboardLocation struct {
+	adminLocation
+	Summary string
+	// PushSuccessRate is the percentage of successful deliveries over every channel, or an empty string if nothing was delivered yet
+	PushSuccessRate string
+	// Failing is true if the latest summary update of the location failed
+	Failing bool
+}
+
+//go:embed admin
+var adminDir embed.FS
+
+// adminRegistration is the admin api representation of a registered subscription
+type adminRegistration struct {
+	ID        uuid.UUID `json:"id"`
+	Channel   string    `json:"channel"`
+	Locations []string  `json:"locations"`
+	// PushService is the host of the push service endpoint of a web push registration, e.g. fcm.googleapis.com
+	PushService string `json:"pushService,omitempty"`
+}
+
+// adminScheduledJob is the admin api representation of the gocron job of a location
+type adminScheduledJob struct {
+	Location string     `json:"location"`
+	LastRun  *time.Time `json:"lastRun"`
+	NextRun  *time.Time `json:"nextRun"`
+}
+
+// adminTestPushResult is the response body of a test push
+type adminTestPushResult struct {
+	Delivered bool `json:"delivered"`
+	// StatusCode is the status code returned by the receiving service if it rejected the test push
+	StatusCode int `json:"statusCode,omitempty"`
+}
+
+// registerAdminRoutes registers the admin dashboard and api on mux.
+// Every route requires the admin token, and responds with 404 if the admin api is disabled.
+func registerAdminRoutes(mux *http.ServeMux, state *state) {
+	admin := func(handler http.HandlerFunc) http.Handler {
+		return requireAdmin(state, handler)
+	}
+
+	dashboard := admin(func(writer http.ResponseWriter, request *http.Request) {
+		renderAdminDashboard(state, writer)
+	})
+	mux.Handle("GET /admin", dashboard)
+	mux.Handle("GET /admin/{$}", dashboard)
+
+	mux.Handle("GET /admin/locations", admin(func(writer http.ResponseWriter, request *http.Request) {
+		writeAdminJSON(writer, listAdminLocations(state))
+	}))
+
+	mux.Handle("POST /admin/locations/{key}/regenerate", admin(func(writer http.ResponseWriter, request *http.Request) {
+		regenerateLocationSummary(state, writer, request, request.PathValue("key"))
+	}))
+
+	mux.Handle("POST /admin/locations/{key}/resend", admin(func(writer http.ResponseWriter, request *http.Request) {
+		resendLocationSummary(state, writer, request.PathValue("key"))
+	}))
+
+	mux.Handle("DELETE /admin/locations/{key}", admin(func(writer http.ResponseWriter, request *http.Request) {
+		locKey := request.PathValue("key")
+		err := removeDynamicLocation(state, locKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(writer, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no location with key %v was added from the location search", locKey), nil)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to remove location", "location", locKey, "error", err)
+			writeInternalError(writer)
+			return
+		}
+
+		writer.WriteHeader(http.StatusNoContent)
+		slog.Info("location removed by admin", "location", locKey)
+	}))
+
+	mux.Handle("GET /admin/registrations", admin(func(writer http.ResponseWriter, request *http.Request) {
+		regs, err := listAdminRegistrations(state)
+		if err != nil {
+			slog.Error("failed to list registrations", "error", err)
+			writeInternalError(writer)
+			return
+		}
+		writeAdminJSON(writer, regs)
+	}))
+
+	mux.Handle("DELETE /admin/registrations/{id}", admin(func(writer http.ResponseWriter, request *http.Request) {
+		regID, err := uuid.Parse(request.PathValue("id"))
+		if err != nil {
+			writeRegistrationError(writer, sql.ErrNoRows)
+			return
+		}
+
+		err = deleteSubscription(state, regID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("failed to delete registration", "id", regID, "error", err)
+			}
+			writeRegistrationError(writer, err)
+			return
+		}
+
+		registrationsDeletedTotal.Inc()
+		writer.WriteHeader(http.StatusNoContent)
+		slog.Info("registration deleted by admin", "id", regID)
+	}))
+
+	mux.Handle("POST /admin/registrations/{id}/test-push", admin(func(writer http.ResponseWriter, request *http.Request) {
+		sendTestPush(state, writer, request.PathValue("id"))
+	}))
+
+	mux.Handle("GET /admin/schedulers", admin(func(writer http.ResponseWriter, request *http.Request) {
+		writeAdminJSON(writer, listAdminScheduledJobs(state))
+	}))
+}
+
+// requireAdmin only passes requests that carry the admin token on to next.
+func requireAdmin(state *state, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if state.adminToken == "" {
+			writeError(writer, http.StatusNotFound, errCodeNotFound, "not found", nil)
+			return
+		}
+
+		if !isAdminAuthorized(state, request) {
+			writer.Header().Add("WWW-Authenticate", "Bearer")
+			writer.Header().Add("WWW-Authenticate", `Basic realm="7am admin"`)
+			writeError(writer, http.StatusUnauthorized, errCodeUnauthorized, "missing or invalid admin token", nil)
+			return
+		}
+
+		// browsers attach cached basic auth credentials to requests from any site,
+		// so state-changing requests from other sites are rejected. a bearer token can not be forged that way.
+		if !isSafeMethod(request.Method) && !strings.HasPrefix(request.Header.Get("Authorization"), "Bearer ") && isCrossOriginRequest(request) {
+			writeError(writer, http.StatusForbidden, errCodeForbidden, "cross-origin admin requests are not allowed", nil)
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// isAdminAuthorized checks that the request carries the admin token, either as a bearer token,
+// or as the password of http basic auth, which is used by the dashboard in the browser.
+func isAdminAuthorized(state *state, request *http.Request) bool {
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = request.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(state.adminToken)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// isCrossOriginRequest reports whether a browser sent the request from a page of another origin.
+// Sec-Fetch-Site is checked if the browser sends it, and Origin otherwise.
+// Requests without either header are not from a browser, or from one too old to send them, and are allowed.
+func isCrossOriginRequest(request *http.Request) bool {
+	if site := request.Header.Get("Sec-Fetch-Site"); site != "" {
+		// "none" is a request that the user made directly, e.g. by typing the url
+		return site != "same-origin" && site != "none"
+	}
+
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != request.Host
+}
+
+func writeAdminJSON(writer http.ResponseWriter, v any) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(v)
+}
+
+// timeOrNil returns nil for the zero time, so that it is encoded as null.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func listAdminLocations(state *state) []adminLocation {
+	var locs []adminLocation
+	for locKey, loc := range supportedLocations() {
+		locs = append(locs, adminLocation{Key: locKey, Name: loc.displayName})
+	}
+
+	// the data is copied out under each lock on its own, so that no lock is held while waiting for another
+	state.subscriptionsMutex.Lock()
+	for i := range locs {
+		locs[i].Subscribers = len(state.subscriptions[locs[i].Key])
+	}
+	state.subscriptionsMutex.Unlock()
+
+	state.locationStatusesMutex.Lock()
+	for i := range locs {
+		status, ok := state.locationStatuses[locs[i].Key]
+		if !ok {
+			continue
+		}
+		l := &locs[i]
+		l.LastUpdated = timeOrNil(status.lastUpdated)
+		l.LastErrorAt = timeOrNil(status.lastErrorAt)
+		if status.lastError != nil {
+			l.LastError = status.lastError.Error()
+		}
+		l.GenerationLatencyMs = status.lastLatency.Milliseconds()
+		l.LastPushAt = timeOrNil(status.lastPushAt)
+		l.PushesSucceeded = status.pushesSucceeded
+		l.PushesFailed = status.pushesFailed
+	}
+	state.locationStatusesMutex.Unlock()
+
+	for i := range locs {
+		if job, ok := scheduledJob(state, locs[i].Key); ok {
+			if t, err := job.NextRun(); err == nil {
+				locs[i].NextRun = timeOrNil(t)
+			}
+		}
+	}
+
+	slices.SortFunc(locs, func(a, b adminLocation) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return locs
+}
+
+// regenerateLocationSummary regenerates the summary of the location synchronously.
+// The new summary is pushed to subscribers only if the push query param is "true".
+func regenerateLocationSummary(state *state, writer http.ResponseWriter, request *http.Request, locKey string) {
+	loc, ok := lookupLocation(locKey)
+	if !ok {
+		writeError(writer, http.StatusNotFound, errCodeUnknownLocation, fmt.Sprintf("unknown location %v", locKey), nil)
+		return
+	}
+
+	slog.Info("summary regeneration requested by admin", "location", locKey)
+
+	// use the server context so that the update completes even if the client disconnects
+	err := updateSummary(state.ctx, state, updateSummaryOptions{
+		locKey:     locKey,
+		location:   loc,
+		pushUpdate: request.URL.Query().Get("push") == "true",
+	})
+	if err != nil {
+		writeError(writer, http.StatusBadGateway, errCodeUpstreamFailed, err.Error(), nil)
+		return
+	}
+
+	summary, _ := state.summaries.Load(locKey)
+	writeAdminJSON(writer, map[string]string{
+		"summary": strings.TrimSpace(summary.(string)),
+	})
+}
+
+// resendLocationSummary pushes the current summary of the location to its subscribers again.
+func resendLocationSummary(state *state, writer http.ResponseWriter, locKey string) {
+	if _, ok := scheduledJob(state, locKey); !ok {
+		writeError(writer, http.StatusNotFound, errCodeUnknownLocation, fmt.Sprintf("unknown location %v", locKey), nil)
+		return
+	}
+
+	summary, ok := state.summaries.Load(locKey)
+	if !ok {
+		writeError(writer, http.StatusConflict, errCodeConflict, fmt.Sprintf("%v has no summary to resend yet", locKey), nil)
+		return
+	}
+
+	advisory := ""
+	var forecast *forecastStats
+	updateLocationStatus(state, locKey, func(status *locationStatus) {
+		advisory = status.lastAdvisory
+		forecast = status.lastForecast
+	})
+
+	slog.Info("summary resend requested by admin", "location", locKey)
+
+	// the push listener may still be busy with a previous push, so don't block the request on it
+	go pushSummaryUpdate(state, locKey, summaryUpdate{summary: summary.(string), advisory: advisory, forecast: forecast})
+
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+func renderAdminDashboard(state *state, writer http.ResponseWriter) {
+	data := adminDashboardData{Now: time.Now()}
+
+	for _, l := range listAdminLocations(state) {
+		row := adminDashboardLocation{
+			adminLocation: l,
+			Failing:       l.LastErrorAt != nil && (l.LastUpdated == nil || l.LastErrorAt.After(*l.LastUpdated)),
+		}
+
+		if summary, ok := state.summaries.Load(l.Key); ok {
+			row.Summary = strings.TrimSpace(summary.(string))
+		}
+
+		if total := l.PushesSucceeded + l.PushesFailed; total > 0 {
+			row.PushSuccessRate = fmt.Sprintf("%.0f%%", float64(l.PushesSucceeded)/float64(total)*100)
+		}
+
+		data.Locations = append(data.Locations, row)
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := state.template.adminDashboard.Execute(writer, data)
+	if err != nil {
+		slog.Error("failed to render admin dashboard", "error", err)
+	}
+}
+
+func listAdminRegistrations(state *state) ([]adminRegistration, error) {
+	rows, err := state.db.Query("SELECT id, channel, locations, subscription_json FROM subscriptions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	regs := []adminRegistration{}
+	for rows.Next() {
+		var id, channel, locations, j string
+		err := rows.Scan(&id, &channel, &locations, &j)
+		if err != nil {
+			return nil, err
+		}
+
+		reg := adminRegistration{
+			ID:        uuid.MustParse(id),
+			Channel:   channel,
+			Locations: strings.Split(locations, ","),
+		}
+
+		s := webpush.Subscription{}
+		if channel == channelWebPush && json.Unmarshal([]byte(j), &s) == nil {
+			if u, err := url.Parse(s.Endpoint); err == nil {
+				reg.PushService = u.Host
+			}
+		}
+
+		regs = append(regs, reg)
+	}
+
+	return regs, rows.Err()
+}
+
+// sendTestPush sends a test notification to the given registration with the notifier of its channel,
+// and responds with whether it was delivered.
+func sendTestPush(state *state, writer http.ResponseWriter, id string) {
+	regID, err := uuid.Parse(id)
+	if err != nil {
+		writeRegistrationError(writer, sql.ErrNoRows)
+		return
+	}
+
+	var channel, locations, j string
+	err = state.db.QueryRow("SELECT channel, locations, subscription_json FROM subscriptions WHERE id = ?", regID).Scan(&channel, &locations, &j)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to query registration", "id", regID, "error", err)
+		}
+		writeRegistrationError(writer, err)
+		return
+	}
+
+	notifier, ok := state.notifiers[channel]
+	if !ok {
+		writeError(writer, http.StatusConflict, errCodeConflict, fmt.Sprintf("channel %v is not enabled", channel), nil)
+		return
+	}
+
+	locKey := strings.Split(locations, ",")[0]
+	loc, ok := lookupLocation(locKey)
+	if !ok {
+		writeError(writer, http.StatusConflict, errCodeUnknownLocation, "the registration is not subscribed to a supported location", nil)
+		return
+	}
+
+	reg := &registeredSubscription{
+		ID:        regID,
+		Channel:   channel,
+		Config:    json.RawMessage(j),
+		Locations: strings.Split(locations, ","),
+	}
+	// a test push is only attempted once, so that the result is returned quickly
+	err = notifier.Notify(state.ctx, reg, &notification{
+		locKey:   locKey,
+		location: loc,
+		summary:  "This is a test notification from 7am.",
+	})
+
+	var deliveryErr *deliveryError
+	switch {
+	case err == nil:
+		slog.Info("test push sent", "id", regID, "channel", channel)
+		writeAdminJSON(writer, adminTestPushResult{Delivered: true})
+
+	case errors.As(err, &deliveryErr) && deliveryErr.statusCode != 0:
+		slog.Info("test push rejected", "id", regID, "channel", channel, "status", deliveryErr.statusCode)
+		writeAdminJSON(writer, adminTestPushResult{StatusCode: deliveryErr.statusCode})
+
+	default:
+		slog.Warn("unable to send test push to registration", "id", regID, "channel", channel, "error", err)
+		writeError(writer, http.StatusBadGateway, errCodeUpstreamFailed, err.Error(), nil)
+	}
+}
+
+func listAdminScheduledJobs(state *state) []adminScheduledJob {
+	var jobs []adminScheduledJob
+	for locKey := range supportedLocations() {
+		job, ok := scheduledJob(state, locKey)
+		if !ok {
+			continue
+		}
+		j := adminScheduledJob{Location: locKey}
+		if t, err := job.LastRun(); err == nil {
+			j.LastRun = timeOrNil(t)
+		}
+		if t, err := job.NextRun(); err == nil {
+			j.NextRun = timeOrNil(t)
+		}
+		jobs = append(jobs, j)
+	}
+
+	slices.SortFunc(jobs, func(a, b adminScheduledJob) int {
+		return strings.Compare(a.Location, b.Location)
+	})
+
+	return jobs
+}
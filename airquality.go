@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// airQualityLevel is a provider-independent classification of how bad the air is expected to be.
+type airQualityLevel int
+
+const (
+	airQualityLow airQualityLevel = iota + 1
+	airQualityModerate
+	airQualityHigh
+	airQualityVeryHigh
+)
+
+// airQualityProvider fetches the air quality forecast of a location for a given day.
+// Providers return nil without an error if they have no coverage for the location.
+type airQualityProvider interface {
+	fetchAirQuality(ctx context.Context, loc *location, day time.Time) (*airQuality, error)
+}
+
+// airQuality is the peak air quality and pollen forecast of a location for a single day.
+// It is passed as-is to the summarizer, so the fields are tagged for json.
+type airQuality struct {
+	Source string          `json:"source"`
+	AQI    float64         `json:"aqi"`
+	Level  airQualityLevel `json:"level"`
+	// Pollutants maps pollutant names to their peak concentration in µg/m³
+	Pollutants map[string]float64 `json:"pollutants"`
+	// Pollen maps pollen types to their peak concentration in grains/m³
+	Pollen map[string]float64 `json:"pollen,omitempty"`
+}
+
+// metAirQualityProvider queries MET Norway's air quality forecast, which only covers Norway.
+type metAirQualityProvider struct {
+	userAgent string
+}
+
+type metAirQualityData struct {
+	Data struct {
+		Time []struct {
+			From      string `json:"from"`
+			Variables map[string]struct {
+				Value float64 `json:"value"`
+			} `json:"variables"`
+		} `json:"time"`
+	} `json:"data"`
+}
+
+// openMeteoAirQualityProvider queries the Open-Meteo air quality API, which has global coverage,
+// and pollen data for Europe.
+type openMeteoAirQualityProvider struct{}
+
+type openMeteoAirQualityData struct {
+	Hourly map[string]json.RawMessage `json:"hourly"`
+}
+
+// regionalAirQualityProvider uses MET for locations in Norway, and the fallback provider elsewhere.
+type regionalAirQualityProvider struct {
+	norway   airQualityProvider
+	fallback airQualityProvider
+}
+
+var metPollutants = map[string]string{
+	"pm10_concentration": "pm10",
+	"pm25_concentration": "pm2_5",
+	"no2_concentration":  "no2",
+	"o3_concentration":   "o3",
+}
+
+var openMeteoPollutants = map[string]string{
+	"pm10":             "pm10",
+	"pm2_5":            "pm2_5",
+	"nitrogen_dioxide": "no2",
+	"ozone":            "o3",
+}
+
+var openMeteoPollen = []string{"alder_pollen", "birch_pollen", "grass_pollen", "mugwort_pollen", "olive_pollen", "ragweed_pollen"}
+
+// newAirQualityProvider creates the air quality provider with the given name.
+// An empty name disables air quality data, in which case nil is returned.
+func newAirQualityProvider(name string, metAPIUserAgent string) (airQualityProvider, error) {
+	met := &metAirQualityProvider{userAgent: metAPIUserAgent}
+	switch name {
+	case "":
+		return nil, nil
+	case "met":
+		return met, nil
+	case "open-meteo":
+		return &regionalAirQualityProvider{norway: met, fallback: &openMeteoAirQualityProvider{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown air quality provider %v", name)
+	}
+}
+
+func parseAirQualityLevel(s string) (airQualityLevel, error) {
+	switch s {
+	case "low":
+		return airQualityLow, nil
+	case "moderate":
+		return airQualityModerate, nil
+	case "", "high":
+		return airQualityHigh, nil
+	case "very-high":
+		return airQualityVeryHigh, nil
+	default:
+		return 0, fmt.Errorf("invalid air quality level %v", s)
+	}
+}
+
+func (l airQualityLevel) String() string {
+	switch l {
+	case airQualityLow:
+		return "low"
+	case airQualityModerate:
+		return "moderate"
+	case airQualityHigh:
+		return "high"
+	case airQualityVeryHigh:
+		return "very high"
+	default:
+		return "unknown"
+	}
+}
+
+func (l airQualityLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// pollenLevel classifies a pollen concentration in grains/m³.
+func pollenLevel(v float64) airQualityLevel {
+	switch {
+	case v < 10:
+		return airQualityLow
+	case v < 50:
+		return airQualityModerate
+	case v < 200:
+		return airQualityHigh
+	default:
+		return airQualityVeryHigh
+	}
+}
+
+// advisory returns a short air quality warning to be appended to the push notification,
+// or an empty string if neither the air quality nor the pollen level reaches threshold.
+func (aq *airQuality) advisory(threshold airQualityLevel) string {
+	var parts []string
+
+	if aq.Level >= threshold {
+		parts = append(parts, fmt.Sprintf("Air quality will be %v today (AQI %.0f).", aq.Level, aq.AQI))
+	}
+
+	var pollen []string
+	for name, v := range aq.Pollen {
+		if pollenLevel(v) >= threshold {
+			pollen = append(pollen, strings.TrimSuffix(name, "_pollen"))
+		}
+	}
+	if len(pollen) > 0 {
+		slices.Sort(pollen)
+		parts = append(parts, fmt.Sprintf("Elevated %v pollen levels expected.", strings.Join(pollen, ", ")))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (p *regionalAirQualityProvider) fetchAirQuality(ctx context.Context, loc *location, day time.Time) (*airQuality, error) {
+	// rough bounding box of mainland norway
+	if loc.lat >= 57.9 && loc.lat <= 71.2 && loc.lon >= 4.5 && loc.lon <= 31.2 {
+		aq, err := p.norway.fetchAirQuality(ctx, loc, day)
+		if err == nil && aq != nil {
+			return aq, nil
+		}
+	}
+	return p.fallback.fetchAirQuality(ctx, loc, day)
+}
+
+func (p *metAirQualityProvider) fetchAirQuality(ctx context.Context, loc *location, day time.Time) (*airQuality, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://api.met.no/weatherapi/airqualityforecast/0.1/?lat=%v&lon=%v", loc.lat, loc.lon), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// the api responds with 4xx for locations outside of norway
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("met air quality api returned status %v", resp.StatusCode)
+	}
+
+	data := metAirQualityData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	aq := &airQuality{
+		Source:     "met",
+		Pollutants: map[string]float64{},
+	}
+
+	y, m, d := day.Date()
+	found := false
+	for _, entry := range data.Data.Time {
+		t, err := time.Parse(time.RFC3339, entry.From)
+		if err != nil {
+			continue
+		}
+		ty, tm, td := t.In(loc.tz).Date()
+		if !(y == ty && m == tm && d == td) {
+			continue
+		}
+		found = true
+
+		if v, ok := entry.Variables["AQI"]; ok {
+			aq.AQI = max(aq.AQI, v.Value)
+		}
+		for k, name := range metPollutants {
+			if v, ok := entry.Variables[k]; ok {
+				aq.Pollutants[name] = max(aq.Pollutants[name], v.Value)
+			}
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	// met's aqi starts at 1, where each whole number is a step up on the scale
+	switch {
+	case aq.AQI < 2:
+		aq.Level = airQualityLow
+	case aq.AQI < 3:
+		aq.Level = airQualityModerate
+	case aq.AQI < 4:
+		aq.Level = airQualityHigh
+	default:
+		aq.Level = airQualityVeryHigh
+	}
+
+	return aq, nil
+}
+
+func (p *openMeteoAirQualityProvider) fetchAirQuality(ctx context.Context, loc *location, day time.Time) (*airQuality, error) {
+	vars := []string{"european_aqi"}
+	for k := range openMeteoPollutants {
+		vars = append(vars, k)
+	}
+	vars = append(vars, openMeteoPollen...)
+
+	q := url.Values{}
+	q.Set("latitude", fmt.Sprint(loc.lat))
+	q.Set("longitude", fmt.Sprint(loc.lon))
+	q.Set("timezone", loc.ianaName)
+	q.Set("forecast_days", "2")
+	q.Set("hourly", strings.Join(vars, ","))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://air-quality-api.open-meteo.com/v1/air-quality?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open-meteo air quality api returned status %v", resp.StatusCode)
+	}
+
+	data := openMeteoAirQualityData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	var times []string
+	err = json.Unmarshal(data.Hourly["time"], &times)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time series in open-meteo response: %w", err)
+	}
+
+	// times are in local time of the location since the timezone param is set
+	date := day.Format("2006-01-02")
+
+	// peak returns the highest value of the given hourly variable today,
+	// and whether any value is available at all.
+	peak := func(name string) (float64, bool) {
+		var values []*float64
+		if json.Unmarshal(data.Hourly[name], &values) != nil {
+			return 0, false
+		}
+		result, ok := 0.0, false
+		for i, v := range values {
+			if v == nil || i >= len(times) || !strings.HasPrefix(times[i], date) {
+				continue
+			}
+			result, ok = max(result, *v), true
+		}
+		return result, ok
+	}
+
+	aqi, ok := peak("european_aqi")
+	if !ok {
+		return nil, nil
+	}
+
+	aq := &airQuality{
+		Source:     "open-meteo",
+		AQI:        aqi,
+		Pollutants: map[string]float64{},
+		Pollen:     map[string]float64{},
+	}
+	for k, name := range openMeteoPollutants {
+		if v, ok := peak(k); ok {
+			aq.Pollutants[name] = v
+		}
+	}
+	for _, k := range openMeteoPollen {
+		if v, ok := peak(k); ok {
+			aq.Pollen[k] = v
+		}
+	}
+
+	// see https://open-meteo.com/en/docs/air-quality-api for the european aqi scale
+	switch {
+	case aqi < 40:
+		aq.Level = airQualityLow
+	case aqi < 60:
+		aq.Level = airQualityModerate
+	case aqi < 80:
+		aq.Level = airQualityHigh
+	default:
+		aq.Level = airQualityVeryHigh
+	}
+
+	return aq, nil
+}
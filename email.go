@@ -0,0 +1,820 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+//go:embed email
+var emailDir embed.FS
+
+const (
+	// emailConfirmationTTL is how long the link in a confirmation email is valid
+	emailConfirmationTTL = 48 * time.Hour
+	// emailSendTimeout is the timeout of sending a single email
+	emailSendTimeout = 30 * time.Second
+	// maxEmailBodySize is the maximum size of the request body of POST /email/subscriptions
+	maxEmailBodySize = 4 << 10
+)
+
+// enhancedStatusCodePattern matches an enhanced status code of an smtp reply, see RFC 3463
+var enhancedStatusCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+const (
+	emailTokenConfirm     = "confirm"
+	emailTokenUnsubscribe = "unsubscribe"
+)
+
+// mailer sends emails over SMTP
+type mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     *mail.Address
+	// tlsMode is "starttls", "tls", or "none"
+	tlsMode string
+	// baseURL is the public url of 7am, which links in emails point to
+	baseURL string
+	// signingKey signs the tokens in confirmation and unsubscribe links
+	signingKey []byte
+
+	templates emailTemplates
+}
+
+type emailTemplates struct {
+	confirmText *template.Template
+	confirmHTML *htmltemplate.Template
+	summaryText *template.Template
+	summaryHTML *htmltemplate.Template
+	page        *htmltemplate.Template
+}
+
+// emailConfig is the channel config of an email registration
+type emailConfig struct {
+	Email string `json:"email"`
+}
+
+// createEmailSubscriptionRequest is the request body of POST /email/subscriptions
+type createEmailSubscriptionRequest struct {
+	Email     string   `json:"email"`
+	Locations []string `json:"locations"`
+}
+
+// confirmEmailTemplateData stores template data for the confirmation email
+type confirmEmailTemplateData struct {
+	Locations  []string
+	ConfirmURL string
+}
+
+// summaryEmailTemplateData stores template data for the summary email
+type summaryEmailTemplateData struct {
+	Location       string
+	Date           string
+	Summary        string
+	Advisory       string
+	SummaryURL     string
+	UnsubscribeURL string
+}
+
+// emailPageTemplateData stores template data for the confirmation and unsubscribe pages
+type emailPageTemplateData struct {
+	Title   string
+	Message string
+	// Action is the label of the button that submits the form of the page, or empty if the page has no form
+	Action string
+}
+
+// newMailerFromEnv configures a mailer from the SMTP_* environment variables.
+// It returns nil if SMTP_HOST is empty, in which case email delivery is disabled.
+func newMailerFromEnv() (*mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	m := &mailer{
+		host:     host,
+		port:     587,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		tlsMode:  cmp.Or(os.Getenv("SMTP_TLS"), "starttls"),
+		baseURL:  strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+	}
+
+	if p := os.Getenv("SMTP_PORT"); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", p)
+		}
+		m.port = port
+	}
+
+	if !slices.Contains([]string{"starttls", "tls", "none"}, m.tlsMode) {
+		return nil, fmt.Errorf(`SMTP_TLS must be "starttls", "tls", or "none", got %q`, m.tlsMode)
+	}
+
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	m.from = from
+
+	if m.baseURL == "" {
+		return nil, errors.New("PUBLIC_URL is required for links in emails")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("EMAIL_SIGNING_KEY_BASE64"))
+	if err != nil || len(key) < 32 {
+		return nil, errors.New("EMAIL_SIGNING_KEY_BASE64 must be at least 32 base64 encoded bytes")
+	}
+	m.signingKey = key
+
+	m.templates, err = loadEmailTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func loadEmailTemplates() (emailTemplates, error) {
+	t := emailTemplates{}
+	var err error
+	if t.confirmText, err = template.ParseFS(emailDir, "email/confirm.txt"); err != nil {
+		return t, err
+	}
+	if t.confirmHTML, err = htmltemplate.ParseFS(emailDir, "email/confirm.html"); err != nil {
+		return t, err
+	}
+	if t.summaryText, err = template.ParseFS(emailDir, "email/summary.txt"); err != nil {
+		return t, err
+	}
+	if t.summaryHTML, err = htmltemplate.ParseFS(emailDir, "email/summary.html"); err != nil {
+		return t, err
+	}
+	if t.page, err = htmltemplate.ParseFS(emailDir, "email/page.html"); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// signToken returns a token for the given purpose and subscription id that expires at the given time,
+// or never if expiry is zero.
+func (m *mailer) signToken(purpose string, id uuid.UUID, expiry time.Time) string {
+	var exp int64
+	if !expiry.IsZero() {
+		exp = expiry.Unix()
+	}
+	payload := fmt.Sprintf("%v:%v:%d", purpose, id, exp)
+	mac := hmac.New(sha256.New, m.signingKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken returns the subscription id of a token that was signed for purpose and has not expired.
+func (m *mailer) verifyToken(purpose string, token string) (uuid.UUID, bool) {
+	p, s, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return uuid.Nil, false
+	}
+
+	mac := hmac.New(sha256.New, m.signingKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return uuid.Nil, false
+	}
+
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 3 || parts[0] != purpose {
+		return uuid.Nil, false
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || (exp != 0 && time.Now().Unix() > exp) {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// buildMessage renders a multipart/alternative email with a plain text and an html part.
+func (m *mailer) buildMessage(to string, subject string, extraHeaders [][2]string, text []byte, html []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	msgID := make([]byte, 16)
+	rand.Read(msgID)
+
+	mw := multipart.NewWriter(&b)
+
+	headers := [][2]string{
+		{"From", m.from.String()},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%x@%v>", msgID, m.host)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+	for _, h := range append(headers, extraHeaders...) {
+		fmt.Fprintf(&b, "%v: %v\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain; charset=utf-8", text}, {"text/html; charset=utf-8", html}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(w)
+		qw.Write(part.body)
+		qw.Close()
+	}
+
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// send delivers msg to a single recipient.
+func (m *mailer) send(ctx context.Context, to string, msg []byte) error {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	tlsConfig := &tls.Config{ServerName: m.host}
+
+	var conn net.Conn
+	var err error
+	if m.tlsMode == "tls" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to smtp server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.tlsMode == "starttls" {
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			return fmt.Errorf("starttls failed: %w", err)
+		}
+	}
+
+	if m.username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.username, m.password, m.host))
+		if err != nil {
+			return fmt.Errorf("smtp authentication failed: %w", err)
+		}
+	}
+
+	if err = c.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// sendConfirmation sends the double opt-in email of a pending subscription.
+func (m *mailer) sendConfirmation(ctx context.Context, id uuid.UUID, to string, locKeys []string) error {
+	data := confirmEmailTemplateData{
+		ConfirmURL: m.baseURL + "/email/confirm?token=" + m.signToken(emailTokenConfirm, id, time.Now().Add(emailConfirmationTTL)),
+	}
+	for _, locKey := range locKeys {
+		if loc, ok := lookupLocation(locKey); ok {
+			data.Locations = append(data.Locations, loc.displayName)
+		}
+	}
+
+	var text, html bytes.Buffer
+	if err := m.templates.confirmText.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := m.templates.confirmHTML.Execute(&html, data); err != nil {
+		return err
+	}
+
+	msg, err := m.buildMessage(to, "Confirm your 7am subscription", nil, text.Bytes(), html.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return m.send(ctx, to, msg)
+}
+
+// ValidateConfig rejects email registrations made through the registration api,
+// since an address has to be confirmed before summaries are sent to it.
+func (m *mailer) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	return nil, errors.New("email registrations are created with POST /email/subscriptions")
+}
+
+// Notify sends the summary of a location to a confirmed email registration.
+func (m *mailer) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	config := emailConfig{}
+	err := json.Unmarshal(reg.Config, &config)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid email config: %w", err)}
+	}
+
+	unsubscribeURL := m.baseURL + "/email/unsubscribe?token=" + m.signToken(emailTokenUnsubscribe, reg.ID, time.Time{})
+	data := summaryEmailTemplateData{
+		Location:       n.location.displayName,
+		Date:           time.Now().In(n.location.tz).Format("Monday, January 2"),
+		Summary:        n.summary,
+		Advisory:       n.advisory,
+		SummaryURL:     m.baseURL + "/" + n.locKey,
+		UnsubscribeURL: unsubscribeURL,
+	}
+
+	var text, html bytes.Buffer
+	if err := m.templates.summaryText.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := m.templates.summaryHTML.Execute(&html, data); err != nil {
+		return err
+	}
+
+	// one-click unsubscribe, see RFC 8058
+	headers := [][2]string{
+		{"List-Unsubscribe", "<" + unsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	}
+	msg, err := m.buildMessage(config.Email, fmt.Sprintf("%v weather for %v", data.Location, data.Date), headers, text.Bytes(), html.Bytes())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, emailSendTimeout)
+	defer cancel()
+
+	err = m.send(ctx, config.Email, msg)
+	// 5xx replies are permanent failures, such as an unknown mailbox, see RFC 5321 section 4.2.1
+	var replyErr *textproto.Error
+	if errors.As(err, &replyErr) {
+		return &deliveryError{statusCode: replyErr.Code, permanent: replyErr.Code >= 500, gone: isUnknownMailboxReply(replyErr), err: err}
+	}
+	return err
+}
+
+// isUnknownMailboxReply reports whether an smtp reply rejects the recipient because its mailbox does not exist.
+// 550 is also used for policy rejections, such as spam filters, so the enhanced status code is checked if the server sends one,
+// which is 5.1.x for an invalid address, see RFC 3463 section 3.2.
+func isUnknownMailboxReply(replyErr *textproto.Error) bool {
+	if replyErr.Code != 550 && replyErr.Code != 551 && replyErr.Code != 553 {
+		return false
+	}
+	enhanced, _, _ := strings.Cut(replyErr.Msg, " ")
+	if !enhancedStatusCodePattern.MatchString(enhanced) {
+		return true
+	}
+	return strings.HasPrefix(enhanced, "5.1.")
+}
+
+// createPendingEmailSubscription stores an unconfirmed subscription, which only receives summaries once it is confirmed.
+// At most one confirmation email is sent to an address per emailConfirmationTTL, so that the endpoint can not be used to flood an inbox.
+// If a confirmation email was already sent to the address within emailConfirmationTTL, no subscription is created,
+// and send is false. The locations then replace those of the pending subscription of that email instead, if it is not confirmed yet,
+// so that the link that was already sent confirms the latest request.
+func createPendingEmailSubscription(state *state, email string, locKeys []string) (id uuid.UUID, send bool, err error) {
+	id, err = uuid.NewV7()
+	if err != nil {
+		return uuid.Nil, false, fmt.Errorf("unable to generate id for email subscription: %w", err)
+	}
+
+	state.dbMutex.Lock()
+	defer state.dbMutex.Unlock()
+
+	tx, err := state.db.Begin()
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	defer tx.Rollback()
+
+	// expired pending subscriptions are cleaned up here, since there is nothing else to do with them
+	_, err = tx.Exec("DELETE FROM email_subscriptions WHERE created_at < ?", time.Now().Add(-emailConfirmationTTL).Unix())
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	// the local part of an address may be case sensitive, but mail servers rarely treat it that way
+	var pendingID string
+	var confirmedAt sql.NullInt64
+	err = tx.QueryRow(
+		"SELECT id, confirmed_at FROM email_subscriptions WHERE lower(email) = lower(?) ORDER BY created_at DESC LIMIT 1",
+		email,
+	).Scan(&pendingID, &confirmedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec(
+			"INSERT INTO email_subscriptions (id, email, locations, created_at) VALUES (?, ?, ?, ?)",
+			id, email, strings.Join(locKeys, ","), time.Now().Unix(),
+		)
+		if err != nil {
+			return uuid.Nil, false, err
+		}
+		send = true
+
+	case err == nil:
+		id = uuid.MustParse(pendingID)
+		if !confirmedAt.Valid {
+			_, err = tx.Exec("UPDATE email_subscriptions SET locations = ? WHERE id = ?", strings.Join(locKeys, ","), id)
+			if err != nil {
+				return uuid.Nil, false, err
+			}
+		}
+
+	default:
+		return uuid.Nil, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	return id, send, nil
+}
+
+// deletePendingEmailSubscription deletes a subscription that has not been confirmed.
+func deletePendingEmailSubscription(state *state, id uuid.UUID) error {
+	state.dbMutex.Lock()
+	defer state.dbMutex.Unlock()
+
+	_, err := state.db.Exec("DELETE FROM email_subscriptions WHERE id = ? AND confirmed_at IS NULL", id)
+	return err
+}
+
+// pendingEmailLocations returns the locations of a pending subscription.
+// sql.ErrNoRows is returned if the subscription does not exist.
+func pendingEmailLocations(state *state, id uuid.UUID) ([]string, error) {
+	state.dbMutex.Lock()
+	defer state.dbMutex.Unlock()
+
+	var locations string
+	err := state.db.QueryRow("SELECT locations FROM email_subscriptions WHERE id = ?", id).Scan(&locations)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(locations, ","), nil
+}
+
+// confirmEmailSubscription confirms a pending subscription by registering the address with the email channel.
+// If the address is already registered, the locations of the pending subscription are added to its registration instead.
+// sql.ErrNoRows is returned if the subscription does not exist.
+func confirmEmailSubscription(state *state, id uuid.UUID) error {
+	state.dbMutex.Lock()
+	defer state.dbMutex.Unlock()
+
+	tx, err := state.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email, locations string
+	var confirmedAt sql.NullInt64
+	err = tx.QueryRow("SELECT email, locations, confirmed_at FROM email_subscriptions WHERE id = ?", id).Scan(&email, &locations, &confirmedAt)
+	if err != nil {
+		return err
+	}
+	if confirmedAt.Valid {
+		// the link was opened twice
+		return nil
+	}
+
+	locs := strings.Split(locations, ",")
+	regID := id
+
+	// addresses are compared ignoring case, like pending subscriptions are
+	var existingID, existingLocations string
+	err = tx.QueryRow(
+		"SELECT id, locations FROM subscriptions WHERE channel = ? AND lower(json_extract(subscription_json, '$.email')) = lower(?)",
+		channelEmail, email,
+	).Scan(&existingID, &existingLocations)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = insertChannelRegistration(tx, id.String(), channelEmail, strings.Join(locs, ","), emailConfig{Email: email})
+		if err != nil {
+			return err
+		}
+
+	case err == nil:
+		for _, l := range strings.Split(existingLocations, ",") {
+			if !slices.Contains(locs, l) {
+				locs = append(locs, l)
+			}
+		}
+		_, err = tx.Exec("UPDATE subscriptions SET locations = ? WHERE id = ?", strings.Join(locs, ","), existingID)
+		if err != nil {
+			return err
+		}
+		regID = uuid.MustParse(existingID)
+
+	default:
+		return err
+	}
+
+	// the pending subscription is kept until it expires, so that opening the link again does not fail
+	_, err = tx.Exec("UPDATE email_subscriptions SET confirmed_at = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(emailConfig{Email: email})
+	if err != nil {
+		return err
+	}
+	indexRegistration(state, &registeredSubscription{
+		ID:        regID,
+		Channel:   channelEmail,
+		Config:    config,
+		Locations: locs,
+	})
+
+	return nil
+}
+
+func handleCreateEmailSubscription(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
+
+		defer request.Body.Close()
+
+		body := createEmailSubscriptionRequest{}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			writeRequestBodyError(writer, err)
+			return
+		}
+
+		addr, err := mail.ParseAddress(body.Email)
+		if err != nil || addr.Name != "" {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "invalid email address", nil)
+			return
+		}
+		if len(body.Locations) == 0 {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "at least one location is required", nil)
+			return
+		}
+		err = checkLocations(body.Locations)
+		if err != nil {
+			writeRegistrationError(writer, err)
+			return
+		}
+		locs := slices.Compact(slices.Sorted(slices.Values(body.Locations)))
+
+		id, send, err := createPendingEmailSubscription(state, addr.Address, locs)
+		if err != nil {
+			logger.Error("failed to create email subscription", "error", err)
+			writeInternalError(writer)
+			return
+		}
+		if !send {
+			logger.Info("confirmation email was sent recently, not sending another one", "id", id, "locations", strings.Join(locs, ","))
+			writer.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(request.Context(), emailSendTimeout)
+		defer cancel()
+		err = state.mailer.sendConfirmation(ctx, id, addr.Address, locs)
+		if err != nil {
+			logger.Error("failed to send confirmation email", "id", id, "error", err)
+			// the address can be subscribed again right away, since no email was sent to it
+			err = deletePendingEmailSubscription(state, id)
+			if err != nil {
+				logger.Warn("failed to delete email subscription", "id", id, "error", err)
+			}
+			writeError(writer, http.StatusBadGateway, errCodeUpstreamFailed, "the confirmation email could not be sent", nil)
+			return
+		}
+
+		logger.Info("email subscription pending confirmation", "id", id, "locations", strings.Join(locs, ","))
+
+		// the response is the same whether or not the address is already subscribed, so that subscribers can not be enumerated
+		writer.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func handleConfirmEmailSubscription(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := state.mailer.verifyToken(emailTokenConfirm, request.URL.Query().Get("token"))
+		if !ok {
+			renderEmailPage(writer, state, http.StatusBadRequest, emailPageTemplateData{
+				Title:   "Invalid link",
+				Message: "This confirmation link is invalid or has expired. Please subscribe again.",
+			})
+			return
+		}
+
+		notFound := emailPageTemplateData{
+			Title:   "Subscription not found",
+			Message: "This subscription has expired or was cancelled. Please subscribe again.",
+		}
+
+		// opening the link only shows a form, so that link scanners of mail providers do not confirm subscriptions.
+		// the form lists the locations, since they may have changed since the email was sent.
+		if request.Method == http.MethodGet {
+			locKeys, err := pendingEmailLocations(state, id)
+			if errors.Is(err, sql.ErrNoRows) {
+				renderEmailPage(writer, state, http.StatusNotFound, notFound)
+				return
+			}
+			if err != nil {
+				requestLogger(request).Error("failed to look up email subscription", "id", id, "error", err)
+				writeInternalError(writer)
+				return
+			}
+
+			var names []string
+			for _, locKey := range locKeys {
+				if loc, ok := lookupLocation(locKey); ok {
+					names = append(names, loc.displayName)
+				}
+			}
+			renderEmailPage(writer, state, http.StatusOK, emailPageTemplateData{
+				Title:   "Confirm your subscription",
+				Message: fmt.Sprintf("Confirm that you want to receive the daily weather summary of %v by email.", strings.Join(names, ", ")),
+				Action:  "Confirm",
+			})
+			return
+		}
+
+		err := confirmEmailSubscription(state, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			renderEmailPage(writer, state, http.StatusNotFound, notFound)
+			return
+		}
+		if err != nil {
+			requestLogger(request).Error("failed to confirm email subscription", "id", id, "error", err)
+			writeInternalError(writer)
+			return
+		}
+
+		requestLogger(request).Info("email subscription confirmed", "id", id)
+
+		renderEmailPage(writer, state, http.StatusOK, emailPageTemplateData{
+			Title:   "Subscribed",
+			Message: "You will receive the daily weather summary by email.",
+		})
+	}
+}
+
+func handleEmailUnsubscribe(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := state.mailer.verifyToken(emailTokenUnsubscribe, request.URL.Query().Get("token"))
+		if !ok {
+			renderEmailPage(writer, state, http.StatusBadRequest, emailPageTemplateData{
+				Title:   "Invalid link",
+				Message: "This unsubscribe link is invalid.",
+			})
+			return
+		}
+
+		if request.Method == http.MethodGet {
+			renderEmailPage(writer, state, http.StatusOK, emailPageTemplateData{
+				Title:   "Unsubscribe",
+				Message: "Stop receiving the daily weather summary by email.",
+				Action:  "Unsubscribe",
+			})
+			return
+		}
+
+		// mail clients unsubscribe with a POST to the same url, see RFC 8058
+		// unsubscribing twice is not an error
+		err := deleteSubscription(state, id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			requestLogger(request).Error("failed to delete email subscription", "id", id, "error", err)
+			writeInternalError(writer)
+			return
+		}
+
+		requestLogger(request).Info("email subscription deleted", "id", id)
+
+		renderEmailPage(writer, state, http.StatusOK, emailPageTemplateData{
+			Title:   "Unsubscribed",
+			Message: "You will no longer receive the daily weather summary by email.",
+		})
+	}
+}
+
+func renderEmailPage(writer http.ResponseWriter, state *state, status int, data emailPageTemplateData) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	state.mailer.templates.page.Execute(writer, data)
+}
+
+// sendTestEmail sends a summary email with sample content to the given address,
+// which is useful to check the smtp configuration against a local smtp sink.
+func sendTestEmail(to string) error {
+	_ = godotenv.Load()
+
+	err := initLocations(os.Getenv("LOCATIONS_FILE"))
+	if err != nil {
+		return err
+	}
+
+	m, err := newMailerFromEnv()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("SMTP_HOST is not set")
+	}
+
+	locKey := supportedLocationKeys()[0]
+	loc, _ := lookupLocation(locKey)
+	config, err := json.Marshal(emailConfig{Email: to})
+	if err != nil {
+		return err
+	}
+	reg := &registeredSubscription{ID: uuid.New(), Channel: channelEmail, Config: config, Locations: []string{locKey}}
+	n := &notification{
+		locKey:   locKey,
+		location: loc,
+		summary:  fmt.Sprintf("This is a test email from 7am. The summary of %v will look like this.", loc.displayName),
+		advisory: "This is where advisories, such as poor air quality, are shown.",
+	}
+
+	return m.Notify(context.Background(), reg, n)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// smtpMessage is an email received by smtpSink
+type smtpMessage struct {
+	from string
+	to   string
+	data string
+}
+
+// smtpSink is a minimal smtp server that accepts every email, except those to rejected recipients.
+type smtpSink struct {
+	addr string
+	// rejected are the recipients that are rejected with 550, like an unknown mailbox
+	rejected []string
+	messages chan smtpMessage
+}
+
+func newSMTPSink(t *testing.T, rejected ...string) *smtpSink {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &smtpSink{
+		addr:     l.Addr().String(),
+		rejected: rejected,
+		messages: make(chan smtpMessage, 10),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP sink")
+
+	msg := smtpMessage{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			msg.from = smtpPathArg(arg)
+			c.PrintfLine("250 2.1.0 ok")
+		case "RCPT":
+			to := smtpPathArg(arg)
+			if slices.Contains(s.rejected, to) {
+				c.PrintfLine("550 5.1.1 no such user")
+				continue
+			}
+			msg.to = to
+			c.PrintfLine("250 2.1.5 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.messages <- msg
+			msg = smtpMessage{}
+			c.PrintfLine("250 2.0.0 queued")
+		case "QUIT":
+			c.PrintfLine("221 2.0.0 bye")
+			return
+		default:
+			c.PrintfLine("502 5.5.1 unknown command")
+		}
+	}
+}
+
+// smtpPathArg returns the address of a MAIL or RCPT argument such as "FROM:<you@example.com>".
+func smtpPathArg(arg string) string {
+	_, path, _ := strings.Cut(arg, "<")
+	path, _, _ = strings.Cut(path, ">")
+	return path
+}
+
+// receive returns the next email that the sink received.
+func (s *smtpSink) receive(t *testing.T) smtpMessage {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was received")
+		return smtpMessage{}
+	}
+}
+
+func newTestMailer(t *testing.T, sink *smtpSink) *mailer {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(sink.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := loadEmailTemplates()
+	if err != nil {
+		t.Fatalf("failed to load email templates: %v", err)
+	}
+
+	return &mailer{
+		host:       host,
+		port:       portNum,
+		from:       &mail.Address{Name: "7am", Address: "7am@example.com"},
+		tlsMode:    "none",
+		baseURL:    "https://7am.example.com",
+		signingKey: bytes.Repeat([]byte{1}, 32),
+		templates:  templates,
+	}
+}
+
+// emailLinkToken returns the token of the first link to path in the decoded body of an email.
+func emailLinkToken(t *testing.T, msg smtpMessage, path string) string {
+	t.Helper()
+
+	body, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(msg.data)))
+	if err != nil {
+		t.Fatalf("failed to decode email: %v", err)
+	}
+	m := regexp.MustCompile(regexp.QuoteMeta(path) + `\?token=([A-Za-z0-9_.-]+)`).FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("email has no link to %v:\n%s", path, body)
+	}
+	return string(m[1])
+}
+
+func TestMailerSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := newTestMailer(t, sink)
+
+	msg, err := m.buildMessage("you@example.com", "Hello", nil, []byte("plain body"), []byte("<p>html body</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.send(context.Background(), "you@example.com", msg)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	got := sink.receive(t)
+	if got.from != "7am@example.com" || got.to != "you@example.com" {
+		t.Errorf("email was sent from %q to %q", got.from, got.to)
+	}
+	for _, want := range []string{"Subject: Hello", "To: you@example.com", "plain body", "<p>html body</p>"} {
+		if !strings.Contains(got.data, want) {
+			t.Errorf("email does not contain %q:\n%v", want, got.data)
+		}
+	}
+}
+
+func TestMailerNotifyRejectedRecipient(t *testing.T) {
+	newTestState(t)
+	sink := newSMTPSink(t, "gone@example.com")
+	m := newTestMailer(t, sink)
+
+	loc, _ := lookupLocation("london")
+	config, _ := json.Marshal(emailConfig{Email: "gone@example.com"})
+	reg := &registeredSubscription{ID: uuid.New(), Channel: channelEmail, Config: config, Locations: []string{"london"}}
+	n := &notification{locKey: "london", location: loc, summary: "It is sunny in London today."}
+
+	err := m.Notify(context.Background(), reg, n)
+	deliveryErr := &deliveryError{}
+	if !errors.As(err, &deliveryErr) {
+		t.Fatalf("expected a delivery error, got %v", err)
+	}
+	if deliveryErr.statusCode != 550 || !deliveryErr.permanent || !deliveryErr.gone {
+		t.Errorf("expected a permanent failure of a gone registration with status 550, got %+v", deliveryErr)
+	}
+}
+
+func TestIsUnknownMailboxReply(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		msg  string
+		want bool
+	}{
+		{550, "5.1.1 no such user", true},
+		{550, "no such user", true},
+		{551, "user not local", true},
+		{550, "5.7.1 message rejected as spam", false},
+		{552, "5.2.2 mailbox full", false},
+		{450, "4.2.1 mailbox busy", false},
+	} {
+		if got := isUnknownMailboxReply(&textproto.Error{Code: tc.code, Msg: tc.msg}); got != tc.want {
+			t.Errorf("%v %v: got %v, expected %v", tc.code, tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	m := &mailer{signingKey: bytes.Repeat([]byte{1}, 32)}
+	id := uuid.New()
+
+	token := m.signToken(emailTokenConfirm, id, time.Now().Add(time.Hour))
+	if got, ok := m.verifyToken(emailTokenConfirm, token); !ok || got != id {
+		t.Errorf("valid token was rejected, got %v, %v", got, ok)
+	}
+	if _, ok := m.verifyToken(emailTokenUnsubscribe, token); ok {
+		t.Error("token was accepted for another purpose")
+	}
+
+	if _, ok := m.verifyToken(emailTokenConfirm, m.signToken(emailTokenConfirm, id, time.Now().Add(-time.Minute))); ok {
+		t.Error("expired token was accepted")
+	}
+	if got, ok := m.verifyToken(emailTokenUnsubscribe, m.signToken(emailTokenUnsubscribe, id, time.Time{})); !ok || got != id {
+		t.Errorf("token without expiry was rejected, got %v, %v", got, ok)
+	}
+
+	// the signature of one token does not sign the payload of another
+	payload, _, _ := strings.Cut(token, ".")
+	_, otherSig, _ := strings.Cut(m.signToken(emailTokenConfirm, uuid.New(), time.Now().Add(time.Hour)), ".")
+	if _, ok := m.verifyToken(emailTokenConfirm, payload+"."+otherSig); ok {
+		t.Error("token with a swapped signature was accepted")
+	}
+
+	other := &mailer{signingKey: bytes.Repeat([]byte{2}, 32)}
+	if _, ok := other.verifyToken(emailTokenConfirm, token); ok {
+		t.Error("token was accepted with another signing key")
+	}
+
+	for _, malformed := range []string{"", "abc", "a.b", payload, payload + "."} {
+		if _, ok := m.verifyToken(emailTokenConfirm, malformed); ok {
+			t.Errorf("malformed token %q was accepted", malformed)
+		}
+	}
+}
+
+func TestEmailSubscriptionConfirmation(t *testing.T) {
+	state := newTestState(t)
+	sink := newSMTPSink(t)
+	state.mailer = newTestMailer(t, sink)
+
+	subscribe := func(body string) int {
+		rec := httptest.NewRecorder()
+		handleCreateEmailSubscription(state)(rec, httptest.NewRequest(http.MethodPost, "/email/subscriptions", strings.NewReader(body)))
+		return rec.Code
+	}
+	confirm := func(method string, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleConfirmEmailSubscription(state)(rec, httptest.NewRequest(method, "/email/confirm?token="+token, nil))
+		return rec
+	}
+
+	// the address is already registered for london, with different case
+	existing := uuid.New()
+	err := insertChannelRegistration(state.db, existing.String(), channelEmail, "london", emailConfig{Email: "you@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(emailConfig{Email: "you@example.com"})
+	indexRegistration(state, &registeredSubscription{ID: existing, Channel: channelEmail, Config: config, Locations: []string{"london"}})
+
+	if code := subscribe(`{"email": "You@Example.com", "locations": ["sf"]}`); code != http.StatusAccepted {
+		t.Fatalf("subscribing responded with %v", code)
+	}
+	token := emailLinkToken(t, sink.receive(t), "/email/confirm")
+
+	// subscribing again while the link is unconfirmed replaces the locations without sending another email
+	if code := subscribe(`{"email": "you@example.COM", "locations": ["la", "sj"]}`); code != http.StatusAccepted {
+		t.Fatalf("subscribing again responded with %v", code)
+	}
+	if len(sink.messages) != 0 {
+		t.Error("a second confirmation email was sent within the confirmation ttl")
+	}
+
+	rec := confirm(http.MethodGet, token)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<form") {
+		t.Errorf("opening the link responded with %v:\n%v", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "Los Angeles") || strings.Contains(body, "San Francisco") {
+		t.Errorf("confirmation page does not list the latest locations:\n%v", body)
+	}
+	var locations string
+	err = state.db.QueryRow("SELECT locations FROM subscriptions WHERE id = ?", existing).Scan(&locations)
+	if err != nil || locations != "london" {
+		t.Fatalf("opening the link changed the registration to %q, %v", locations, err)
+	}
+
+	if rec := confirm(http.MethodPost, token); rec.Code != http.StatusOK {
+		t.Fatalf("confirming responded with %v:\n%v", rec.Code, rec.Body)
+	}
+	if n := countEmailRegistrations(t, state); n != 1 {
+		t.Fatalf("confirming left %v registrations, expected the existing one", n)
+	}
+	err = state.db.QueryRow("SELECT locations FROM subscriptions WHERE id = ?", existing).Scan(&locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locations != "la,sj,london" {
+		t.Errorf("registration has locations %q", locations)
+	}
+	if len(state.subscriptions["london"]) != 1 || len(state.subscriptions["la"]) != 1 || len(state.subscriptions["sf"]) != 0 {
+		t.Error("registration was not indexed by its locations")
+	}
+
+	// the link may be opened twice
+	if rec := confirm(http.MethodPost, token); rec.Code != http.StatusOK {
+		t.Errorf("confirming again responded with %v", rec.Code)
+	}
+	if n := countEmailRegistrations(t, state); n != 1 {
+		t.Errorf("confirming again left %v registrations", n)
+	}
+
+	if rec := confirm(http.MethodPost, token+"x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("confirming with an invalid token responded with %v", rec.Code)
+	}
+	unsubscribeToken := state.mailer.signToken(emailTokenUnsubscribe, uuid.New(), time.Time{})
+	if rec := confirm(http.MethodPost, unsubscribeToken); rec.Code != http.StatusBadRequest {
+		t.Errorf("confirming with an unsubscribe token responded with %v", rec.Code)
+	}
+}
+
+func TestEmailSubscriptionInvalidRequest(t *testing.T) {
+	state := newTestState(t)
+	sink := newSMTPSink(t)
+	state.mailer = newTestMailer(t, sink)
+
+	for _, body := range []string{
+		`{"email": "not an address", "locations": ["london"]}`,
+		`{"email": "You <you@example.com>", "locations": ["london"]}`,
+		`{"email": "you@example.com", "locations": []}`,
+		`{"email": "you@example.com", "locations": ["atlantis"]}`,
+		`{`,
+	} {
+		rec := httptest.NewRecorder()
+		handleCreateEmailSubscription(state)(rec, httptest.NewRequest(http.MethodPost, "/email/subscriptions", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v responded with %v", body, rec.Code)
+		}
+	}
+	if len(sink.messages) != 0 {
+		t.Error("an email was sent for an invalid request")
+	}
+}
+
+func TestEmailSubscriptionSendFailure(t *testing.T) {
+	state := newTestState(t)
+	sink := newSMTPSink(t, "gone@example.com")
+	state.mailer = newTestMailer(t, sink)
+
+	rec := httptest.NewRecorder()
+	handleCreateEmailSubscription(state)(rec, httptest.NewRequest(http.MethodPost, "/email/subscriptions", strings.NewReader(`{"email": "gone@example.com", "locations": ["london"]}`)))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("subscribing a rejected address responded with %v", rec.Code)
+	}
+
+	// the address is not put on cooldown, since no email was sent to it
+	var n int
+	err := state.db.QueryRow("SELECT count(*) FROM email_subscriptions").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%v pending subscriptions were kept after the confirmation email failed", n)
+	}
+}
+
+func TestEmailUnsubscribe(t *testing.T) {
+	state := newTestState(t)
+	state.mailer = newTestMailer(t, newSMTPSink(t))
+
+	id := uuid.New()
+	err := insertChannelRegistration(state.db, id.String(), channelEmail, "london", emailConfig{Email: "you@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(emailConfig{Email: "you@example.com"})
+	indexRegistration(state, &registeredSubscription{ID: id, Channel: channelEmail, Config: config, Locations: []string{"london"}})
+
+	unsubscribe := func(method string, token string) int {
+		rec := httptest.NewRecorder()
+		handleEmailUnsubscribe(state)(rec, httptest.NewRequest(method, "/email/unsubscribe?token="+token, nil))
+		return rec.Code
+	}
+
+	if code := unsubscribe(http.MethodPost, state.mailer.signToken(emailTokenConfirm, id, time.Now().Add(time.Hour))); code != http.StatusBadRequest {
+		t.Errorf("unsubscribing with a confirmation token responded with %v", code)
+	}
+
+	token := state.mailer.signToken(emailTokenUnsubscribe, id, time.Time{})
+	if code := unsubscribe(http.MethodGet, token); code != http.StatusOK {
+		t.Errorf("opening the link responded with %v", code)
+	}
+	if n := countEmailRegistrations(t, state); n != 1 {
+		t.Fatal("opening the link deleted the registration")
+	}
+
+	if code := unsubscribe(http.MethodPost, token); code != http.StatusOK {
+		t.Errorf("unsubscribing responded with %v", code)
+	}
+	if n := countEmailRegistrations(t, state); n != 0 {
+		t.Error("unsubscribing did not delete the registration")
+	}
+	if len(state.subscriptions["london"]) != 0 {
+		t.Error("unsubscribing did not remove the registration from its locations")
+	}
+
+	// unsubscribing twice is not an error
+	if code := unsubscribe(http.MethodPost, token); code != http.StatusOK {
+		t.Errorf("unsubscribing again responded with %v", code)
+	}
+}
+
+func countEmailRegistrations(t *testing.T, state *state) int {
+	t.Helper()
+	var n int
+	err := state.db.QueryRow("SELECT count(*) FROM subscriptions WHERE channel = ?", channelEmail).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
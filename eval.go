@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"google.golang.org/genai"
+)
+
+// evalFixture is a recorded MET forecast that the summarizer is evaluated against.
+// The forecast field stores the response of the MET locationforecast compact endpoint as-is.
+type evalFixture struct {
+	Location string     `json:"location"`
+	Date     string     `json:"date"`
+	Forecast metAPIData `json:"forecast"`
+}
+
+// evalCheck is the result of one automated check on a generated summary
+type evalCheck struct {
+	name   string
+	passed bool
+	detail string
+}
+
+// evalResult stores the outcome of evaluating a single fixture
+type evalResult struct {
+	fixture string
+	summary string
+	checks  []evalCheck
+	err     error
+}
+
+// temperaturePattern matches temperatures such as "15°C", "59 °F", "-2 degrees celsius" and ranges such as "12-18°C".
+var temperaturePattern = regexp.MustCompile(`(?i)(-?\d+(?:\.\d+)?)(?:\s*(?:-|–|to)\s*(-?\d+(?:\.\d+)?))?\s*(?:°|degrees?)\s*(c|f|celsius|fahrenheit)\b`)
+
+var umbrellaPattern = regexp.MustCompile(`(?i)umbrella`)
+
+// noUmbrellaPattern matches a clause that advises against an umbrella
+var noUmbrellaPattern = regexp.MustCompile(`(?i)\b(no|not|without|unnecessary|leave)\b.*umbrella|n't.*umbrella|umbrella.*(\bnot\b|n't|unnecessary)`)
+
+// clauseSeparatorPattern splits a summary into clauses, so that advice in one clause is not negated by another,
+// such as in "no rain this morning, but bring an umbrella"
+var clauseSeparatorPattern = regexp.MustCompile(`(?i)[.,;:!?]|\b(but|though|although|however|yet)\b`)
+
+var umbrellaReminderPattern = regexp.MustCompile(`(?i)(don't|do not) forget`)
+
+var datePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\d{4}-\d{2}-\d{2}`),
+	regexp.MustCompile(`\d{1,2}/\d{1,2}/\d{2,4}`),
+	regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|sept|oct|nov|dec)[a-z]*\.? \d{1,2}(st|nd|rd|th)?\b`),
+	regexp.MustCompile(`(?i)\b\d{1,2}(st|nd|rd|th)? (of )?(jan|feb|mar|apr|may|jun|jul|aug|sep|sept|oct|nov|dec)[a-z]*\b`),
+}
+
+// runEval generates summaries for every fixture in dir, checks them, and prints a report to stdout.
+// An error is returned if any fixture fails.
+func runEval(dir string) error {
+	_ = godotenv.Load()
+	err := initLocations(os.Getenv("LOCATIONS_FILE"))
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("GEMINI_API_KEY") == "" {
+		return fmt.Errorf("missing env: GEMINI_API_KEY")
+	}
+
+	prompts, err := loadPrompts(os.Getenv("PROMPT_DIR"))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	genaiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:     os.Getenv("GEMINI_API_KEY"),
+		Backend:    genai.BackendGeminiAPI,
+		HTTPClient: httpClient,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize gemini client: %w", err)
+	}
+
+	state := &state{
+		ctx:     ctx,
+		genai:   genaiClient,
+		prompts: prompts,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no fixtures found in %v", dir)
+	}
+	slices.Sort(files)
+
+	failed := 0
+	for _, f := range files {
+		result := evalFixtureFile(ctx, state, f)
+		printEvalResult(result)
+		if !result.passed() {
+			failed++
+		}
+	}
+
+	fmt.Printf("\n%d/%d fixtures passed\n", len(files)-failed, len(files))
+
+	if failed > 0 {
+		return fmt.Errorf("%d fixtures failed evaluation", failed)
+	}
+	return nil
+}
+
+// recordFixtures fetches the current forecast of every supported location, and saves them as fixtures in dir.
+func recordFixtures(dir string) error {
+	_ = godotenv.Load()
+	err := initLocations(os.Getenv("LOCATIONS_FILE"))
+	if err != nil {
+		return err
+	}
+
+	userAgent := os.Getenv("MET_API_USER_AGENT")
+	if userAgent == "" {
+		return fmt.Errorf("missing env: MET_API_USER_AGENT")
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create fixture directory at %v: %w", dir, err)
+	}
+
+	for locKey, loc := range supportedLocations() {
+		data, err := fetchForecast(context.Background(), userAgent, loc)
+		if err != nil {
+			return fmt.Errorf("failed to query weather data for %v: %w", locKey, err)
+		}
+
+		date := time.Now().In(loc.tz).Format("2006-01-02")
+		b, err := json.Marshal(evalFixture{
+			Location: locKey,
+			Date:     date,
+			Forecast: *data,
+		})
+		if err != nil {
+			return err
+		}
+
+		p := filepath.Join(dir, fmt.Sprintf("%v-%v.json", locKey, date))
+		err = os.WriteFile(p, b, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write fixture %v: %w", p, err)
+		}
+
+		fmt.Printf("recorded %v\n", p)
+	}
+
+	return nil
+}
+
+func evalFixtureFile(ctx context.Context, state *state, path string) evalResult {
+	result := evalResult{fixture: filepath.Base(path)}
+
+	input, stats, err := loadEvalFixture(path)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	summary, err := generateSummary(ctx, state, input)
+	if err != nil {
+		result.err = fmt.Errorf("failed to generate summary: %w", err)
+		return result
+	}
+
+	result.summary = strings.TrimSpace(summary)
+	result.checks = checkSummary(summary, stats, state.prompts.newPromptData(input.locKey, input.location, "").Units)
+
+	return result
+}
+
+// loadEvalFixture reads the fixture at path, and returns the input to generate its summary from,
+// along with the stats of its forecast that the summary is checked against.
+func loadEvalFixture(path string) (summaryInput, forecastStats, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return summaryInput{}, forecastStats{}, err
+	}
+
+	fixture := evalFixture{}
+	err = json.Unmarshal(b, &fixture)
+	if err != nil {
+		return summaryInput{}, forecastStats{}, fmt.Errorf("invalid fixture: %w", err)
+	}
+
+	loc, ok := lookupLocation(fixture.Location)
+	if !ok {
+		return summaryInput{}, forecastStats{}, fmt.Errorf("unknown location %v", fixture.Location)
+	}
+
+	today, err := time.ParseInLocation("2006-01-02", fixture.Date, loc.tz)
+	if err != nil {
+		return summaryInput{}, forecastStats{}, fmt.Errorf("invalid date %v: %w", fixture.Date, err)
+	}
+
+	timeSeries := todaysTimeSeries(&fixture.Forecast, loc, today)
+	stats, ok := computeForecastStats(timeSeries)
+	if !ok {
+		return summaryInput{}, forecastStats{}, fmt.Errorf("fixture has no temperature data for %v", fixture.Date)
+	}
+
+	input := summaryInput{
+		locKey:     fixture.Location,
+		location:   loc,
+		today:      today,
+		timeSeries: timeSeries,
+	}
+	return input, stats, nil
+}
+
+// checkSummary runs every check on summary. units are the temperature units that the summary was asked to use.
+func checkSummary(summary string, stats forecastStats, units string) []evalCheck {
+	return []evalCheck{
+		checkTemperatureRange(summary, stats),
+		checkUmbrellaAdvice(summary, stats),
+		checkTemperatureUnits(summary, units),
+		checkNoDate(summary),
+	}
+}
+
+func (r evalResult) passed() bool {
+	if r.err != nil {
+		return false
+	}
+	for _, c := range r.checks {
+		if !c.passed {
+			return false
+		}
+	}
+	return true
+}
+
+func printEvalResult(r evalResult) {
+	status := "PASS"
+	if !r.passed() {
+		status = "FAIL"
+	}
+	fmt.Printf("%v %v\n", status, r.fixture)
+
+	if r.err != nil {
+		fmt.Printf("  error: %v\n", r.err)
+		return
+	}
+
+	for _, c := range r.checks {
+		mark := "ok  "
+		if !c.passed {
+			mark = "FAIL"
+		}
+		fmt.Printf("  %v %v: %v\n", mark, c.name, c.detail)
+	}
+	fmt.Printf("  summary: %v\n", r.summary)
+}
+
+// mentionedTemperatures returns every temperature mentioned in the summary, converted to celsius.
+func mentionedTemperatures(summary string) []float64 {
+	var temps []float64
+	for _, m := range temperaturePattern.FindAllStringSubmatch(summary, -1) {
+		isFahrenheit := strings.HasPrefix(strings.ToLower(m[3]), "f")
+		for _, s := range m[1:3] {
+			if s == "" {
+				continue
+			}
+			t, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			if isFahrenheit {
+				t = (t - 32) * 5 / 9
+			}
+			temps = append(temps, t)
+		}
+	}
+	return temps
+}
+
+// checkTemperatureRange checks that every mentioned temperature is within the forecast min/max.
+// A tolerance of 2°C is allowed to account for rounding and "feels like" temperatures.
+func checkTemperatureRange(summary string, stats forecastStats) evalCheck {
+	const tolerance = 2
+
+	c := evalCheck{name: "temperature range", passed: true}
+
+	temps := mentionedTemperatures(summary)
+	if len(temps) == 0 {
+		c.passed = false
+		c.detail = "no temperature mentioned"
+		return c
+	}
+
+	for _, t := range temps {
+		if t < stats.minTemp-tolerance || t > stats.maxTemp+tolerance {
+			c.passed = false
+			c.detail = fmt.Sprintf("%.1f°C is outside of forecast range %.1f°C to %.1f°C", t, stats.minTemp, stats.maxTemp)
+			return c
+		}
+	}
+
+	c.detail = fmt.Sprintf("%d temperatures within %.1f°C to %.1f°C", len(temps), stats.minTemp, stats.maxTemp)
+	return c
+}
+
+// checkUmbrellaAdvice checks that an umbrella is recommended on wet days, and not on dry days.
+// Days with only traces of rain are not checked.
+func checkUmbrellaAdvice(summary string, stats forecastStats) evalCheck {
+	c := evalCheck{name: "umbrella advice", passed: true}
+
+	recommended := umbrellaRecommended(summary)
+
+	wet := stats.maxPrecipitation >= 0.5 || stats.totalPrecipitation >= 1
+	dry := stats.totalPrecipitation == 0
+
+	switch {
+	case wet && !recommended:
+		c.passed = false
+		c.detail = fmt.Sprintf("%.1fmm of rain forecast, but no umbrella is recommended", stats.totalPrecipitation)
+	case dry && recommended:
+		c.passed = false
+		c.detail = "no rain forecast, but an umbrella is recommended"
+	case !wet && !dry:
+		c.detail = fmt.Sprintf("only %.1fmm of rain forecast, skipped", stats.totalPrecipitation)
+	default:
+		c.detail = fmt.Sprintf("%.1fmm of rain forecast, umbrella recommended: %v", stats.totalPrecipitation, recommended)
+	}
+
+	return c
+}
+
+// umbrellaRecommended reports whether any clause of summary recommends an umbrella.
+func umbrellaRecommended(summary string) bool {
+	s := umbrellaReminderPattern.ReplaceAllString(summary, "")
+	for _, clause := range clauseSeparatorPattern.Split(s, -1) {
+		if umbrellaPattern.MatchString(clause) && !noUmbrellaPattern.MatchString(clause) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTemperatureUnits checks that temperatures are given in the requested units, and only in those.
+// Units that name neither celsius nor fahrenheit are not checked.
+func checkTemperatureUnits(summary string, units string) evalCheck {
+	c := evalCheck{name: "temperature units", passed: true}
+
+	want, ok := parseTemperatureUnits(units)
+	if !ok {
+		c.detail = fmt.Sprintf("%q is not checked", units)
+		return c
+	}
+
+	var got temperatureUnits
+	for _, m := range temperaturePattern.FindAllStringSubmatch(summary, -1) {
+		if strings.HasPrefix(strings.ToLower(m[3]), "f") {
+			got.fahrenheit = true
+		} else {
+			got.celsius = true
+		}
+	}
+
+	switch {
+	case !got.celsius && !got.fahrenheit:
+		c.passed = false
+		c.detail = "no temperature units found"
+	case want.celsius && !got.celsius:
+		c.passed = false
+		c.detail = "celsius missing"
+	case want.fahrenheit && !got.fahrenheit:
+		c.passed = false
+		c.detail = "fahrenheit missing"
+	case !want.celsius && got.celsius:
+		c.passed = false
+		c.detail = "celsius given, but not requested"
+	case !want.fahrenheit && got.fahrenheit:
+		c.passed = false
+		c.detail = "fahrenheit given, but not requested"
+	default:
+		c.detail = fmt.Sprintf("%v present", units)
+	}
+
+	return c
+}
+
+// checkNoDate checks that the summary does not mention a date.
+func checkNoDate(summary string) evalCheck {
+	c := evalCheck{name: "no date", passed: true, detail: "no date mentioned"}
+	for _, p := range datePatterns {
+		if m := p.FindString(summary); m != "" {
+			c.passed = false
+			c.detail = fmt.Sprintf("date mentioned: %q", m)
+			break
+		}
+	}
+	return c
+}
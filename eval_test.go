@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadEvalFixture(t *testing.T) {
+	newTestState(t)
+
+	for _, tc := range []struct {
+		file               string
+		minTemp, maxTemp   float64
+		totalPrecipitation float64
+		// good passes every check, bad fails at least one
+		good, bad string
+	}{
+		{
+			"london-2026-01-15.json", 3, 8, 6,
+			"A cold and wet day in London, between 3°C (37°F) and 8°C (46°F). Rain sets in after lunch, so bring an umbrella.",
+			"A cold day in London, between 3°C (37°F) and 8°C (46°F). It stays dry, so leave the umbrella at home.",
+		},
+		{
+			"sf-2026-07-01.json", 13, 21, 0,
+			"Sunny skies over San Francisco today, warming from 13°C (55°F) to 21°C (70°F) with no rain in sight.",
+			"Sunny skies over San Francisco on July 1st, warming from 13°C (55°F) to 21°C (70°F).",
+		},
+		{
+			"london-2026-04-20.json", 9, 15, 0.3,
+			"A mild spring day in London, 9-15°C (48-59°F), with a brief drizzle in the late morning.",
+			"A mild spring day in London, around 15°C, with a brief drizzle in the late morning.",
+		},
+	} {
+		input, stats, err := loadEvalFixture(filepath.Join("testdata", "eval", tc.file))
+		if err != nil {
+			t.Errorf("%v: %v", tc.file, err)
+			continue
+		}
+		if len(input.timeSeries) != 24 {
+			t.Errorf("%v: expected 24 hours of today, got %v", tc.file, len(input.timeSeries))
+		}
+		if stats.minTemp != tc.minTemp || stats.maxTemp != tc.maxTemp || math.Abs(stats.totalPrecipitation-tc.totalPrecipitation) > 0.01 {
+			t.Errorf("%v: unexpected stats %+v", tc.file, stats)
+		}
+
+		for _, c := range checkSummary(tc.good, stats, defaultPromptUnits) {
+			if !c.passed {
+				t.Errorf("%v: good summary failed %v: %v", tc.file, c.name, c.detail)
+			}
+		}
+		failed := false
+		for _, c := range checkSummary(tc.bad, stats, defaultPromptUnits) {
+			failed = failed || !c.passed
+		}
+		if !failed {
+			t.Errorf("%v: bad summary passed every check", tc.file)
+		}
+	}
+}
+
+func TestCheckTemperatureRange(t *testing.T) {
+	stats := forecastStats{minTemp: 10, maxTemp: 20}
+	for _, tc := range []struct {
+		summary string
+		passed  bool
+	}{
+		{"between 10°C and 20°C", true},
+		{"highs of 21 degrees celsius", true},
+		{"around 12-18°C", true},
+		{"up to 68°F", true},
+		{"up to 25°C", false},
+		{"lows of 30°F", false},
+		{"a mild day", false},
+	} {
+		if c := checkTemperatureRange(tc.summary, stats); c.passed != tc.passed {
+			t.Errorf("%q: passed is %v, expected %v (%v)", tc.summary, c.passed, tc.passed, c.detail)
+		}
+	}
+}
+
+func TestCheckUmbrellaAdvice(t *testing.T) {
+	wet := forecastStats{totalPrecipitation: 5, maxPrecipitation: 2}
+	dry := forecastStats{}
+	showers := forecastStats{totalPrecipitation: 0.3, maxPrecipitation: 0.2}
+
+	for _, tc := range []struct {
+		summary string
+		stats   forecastStats
+		passed  bool
+	}{
+		{"Rain all day, bring an umbrella.", wet, true},
+		{"Don't forget your umbrella.", wet, true},
+		{"No rain this morning, but bring an umbrella for the afternoon.", wet, true},
+		{"It stays dry until noon; take an umbrella later.", wet, true},
+		{"Rain all day.", wet, false},
+		{"You won't need an umbrella.", wet, false},
+		{"Sunny all day, leave the umbrella at home.", dry, true},
+		{"Sunny all day, no umbrella needed.", dry, true},
+		{"An umbrella is not necessary.", dry, true},
+		{"Sunny all day.", dry, true},
+		{"Sunny, but bring an umbrella just in case.", dry, false},
+		{"Bring an umbrella.", showers, true},
+		{"No umbrella needed.", showers, true},
+	} {
+		if c := checkUmbrellaAdvice(tc.summary, tc.stats); c.passed != tc.passed {
+			t.Errorf("%q: passed is %v, expected %v (%v)", tc.summary, c.passed, tc.passed, c.detail)
+		}
+	}
+}
+
+func TestCheckTemperatureUnits(t *testing.T) {
+	for _, tc := range []struct {
+		summary string
+		units   string
+		passed  bool
+	}{
+		{"15°C (59°F)", "celsius and fahrenheit", true},
+		{"15°C", "celsius and fahrenheit", false},
+		{"59°F", "celsius and fahrenheit", false},
+		{"15 degrees celsius", "celsius", true},
+		{"15°C (59°F)", "celsius", false},
+		{"59°F", "fahrenheit", true},
+		{"15°C", "fahrenheit", false},
+		{"a mild day", "celsius", false},
+		{"15°C", "kelvin", true},
+	} {
+		if c := checkTemperatureUnits(tc.summary, tc.units); c.passed != tc.passed {
+			t.Errorf("%q in %v: passed is %v, expected %v (%v)", tc.summary, tc.units, c.passed, tc.passed, c.detail)
+		}
+	}
+}
+
+func TestCheckNoDate(t *testing.T) {
+	for _, tc := range []struct {
+		summary string
+		passed  bool
+	}{
+		{"Sunny today, 15°C.", true},
+		{"Sunny on 2026-07-01.", false},
+		{"Sunny on 7/1/26.", false},
+		{"Sunny on July 1st.", false},
+		{"Sunny on the 1st of July.", false},
+		{"Sunny in May, as always.", true},
+	} {
+		if c := checkNoDate(tc.summary); c.passed != tc.passed {
+			t.Errorf("%q: passed is %v, expected %v (%v)", tc.summary, c.passed, tc.passed, c.detail)
+		}
+	}
+}
+
+// roundTripFunc lets a function respond to the requests of an http.Client
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestFetchForecastStatus(t *testing.T) {
+	newTestState(t)
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+
+	loc, _ := lookupLocation("london")
+	for _, tc := range []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNonAuthoritativeInfo, true},
+		{http.StatusForbidden, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		httpClient = &http.Client{Transport: roundTripFunc(func(request *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: tc.status,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				// error pages of the api are also valid json
+				Body: io.NopCloser(strings.NewReader(`{"properties": {"timeseries": []}}`)),
+			}, nil
+		})}
+
+		_, err := fetchForecast(context.Background(), "7am-test", loc)
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("status %v: got error %v", tc.status, err)
+		}
+	}
+}
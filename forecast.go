@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genai"
+)
+
+// summaryInput stores everything that is needed to generate a weather summary for a location
+type summaryInput struct {
+	locKey   string
+	location *location
+	today    time.Time
+	// timeSeries is the MET forecast time series for today only
+	timeSeries []map[string]any
+	// airQuality is optional
+	airQuality *airQuality
+}
+
+// forecastStats stores aggregated values of today's forecast
+type forecastStats struct {
+	minTemp float64
+	maxTemp float64
+	// totalPrecipitation is the sum of hourly precipitation in mm
+	totalPrecipitation float64
+	// maxPrecipitation is the highest hourly precipitation in mm
+	maxPrecipitation float64
+}
+
+// fetchForecast queries the MET locationforecast API for the given location.
+func fetchForecast(ctx context.Context, userAgent string, loc *location) (*metAPIData, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://api.met.no/weatherapi/locationforecast/2.0/compact?lat=%v&lon=%v", loc.lat, loc.lon), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	// the api also responds with 203 for deprecated products, which still contains a forecast
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("met locationforecast api returned status %v", resp.StatusCode)
+	}
+
+	data := metAPIData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode received weather data: %w", err)
+	}
+
+	return &data, nil
+}
+
+// todaysTimeSeries removes entries of the time series that are not on the same local date as today.
+func todaysTimeSeries(data *metAPIData, loc *location, today time.Time) []map[string]any {
+	y, m, d := today.Date()
+
+	return slices.DeleteFunc(data.Properties.TimeSeries, func(series map[string]any) bool {
+		if ts, ok := series["time"].(string); ok {
+			t, err := time.Parse(time.RFC3339, ts)
+			if err != nil {
+				return false
+			}
+			ty, tm, td := t.In(loc.tz).Date()
+			return !(y == ty && m == tm && d == td)
+		}
+		return false
+	})
+}
+
+// lookupNumber follows path through nested json objects, and returns the number at the end of it.
+func lookupNumber(m map[string]any, path ...string) (float64, bool) {
+	var v any = m
+	for _, k := range path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, false
+		}
+		v = obj[k]
+	}
+	n, ok := v.(float64)
+	return n, ok
+}
+
+// computeForecastStats aggregates the given time series.
+// ok is false if the time series contains no temperature at all.
+func computeForecastStats(timeSeries []map[string]any) (stats forecastStats, ok bool) {
+	stats.minTemp = math.Inf(1)
+	stats.maxTemp = math.Inf(-1)
+
+	for _, series := range timeSeries {
+		if t, found := lookupNumber(series, "data", "instant", "details", "air_temperature"); found {
+			stats.minTemp = min(stats.minTemp, t)
+			stats.maxTemp = max(stats.maxTemp, t)
+			ok = true
+		}
+		if p, found := lookupNumber(series, "data", "next_1_hours", "details", "precipitation_amount"); found {
+			stats.totalPrecipitation += p
+			stats.maxPrecipitation = max(stats.maxPrecipitation, p)
+		}
+	}
+
+	return stats, ok
+}
+
+// generateSummary asks gemini to summarize the given forecast.
+func generateSummary(ctx context.Context, state *state, input summaryInput) (string, error) {
+	b, err := json.Marshal(input.timeSeries)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal processed time series data: %w", err)
+	}
+
+	p, err := state.prompts.render(state.prompts.newPromptData(input.locKey, input.location, input.today.Format("2006-01-02")))
+	if err != nil {
+		return "", err
+	}
+
+	parts := []*genai.Part{
+		{Text: p},
+		{Text: string(b)},
+	}
+
+	if input.airQuality != nil {
+		b, err := json.Marshal(input.airQuality)
+		if err == nil {
+			parts = append(parts,
+				&genai.Part{Text: "Below is the air quality and pollen forecast for today. Only mention it briefly in the summary if it is worth noting."},
+				&genai.Part{Text: string(b)},
+			)
+		}
+	}
+
+	ctx, span := tracer.Start(ctx, "gemini.generate", trace.WithAttributes(attribute.String("location", input.locKey)))
+	result, err := state.genai.Models.GenerateContent(ctx, "gemini-2.0-flash", []*genai.Content{{
+		Parts: parts,
+	}}, nil)
+	endSpan(span, err)
+	geminiCallsTotal.WithLabelValues(resultLabel(err)).Inc()
+	if err != nil {
+		return "", err
+	}
+
+	if usage := result.UsageMetadata; usage != nil {
+		geminiTokensTotal.WithLabelValues("prompt").Add(float64(usage.PromptTokenCount))
+		geminiTokensTotal.WithLabelValues("candidates").Add(float64(usage.CandidatesTokenCount))
+		geminiTokensTotal.WithLabelValues("total").Add(float64(usage.TotalTokenCount))
+	}
+
+	return result.Text(), nil
+}
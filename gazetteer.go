@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// gazetteerDir contains place lists in the GeoNames dump format, see https://download.geonames.org/export/dump/readme.txt
+// tzdata.txt is generated from the reference cities of the tz database, and places.txt lists about 650 major cities
+// of every region, so that common cities such as Kraków are found even without a GeoNames dump.
+// The docker image additionally downloads cities15000.txt, which lists every city with a population of at least 15000.
+//
+//go:embed gazetteer
+var gazetteerDir embed.FS
+
+const (
+	// maxSearchResults is the maximum number of places returned by a gazetteer search
+	maxSearchResults = 10
+	// minFuzzyQueryLength is the minimum query length for which misspelled names are matched
+	minFuzzyQueryLength = 4
+	// minSearchQueryLength is the minimum length of the q parameter of GET /api/locations/search
+	minSearchQueryLength = 2
+	// sameLocationRadiusKm is the distance within which a place or the coordinates sent by a browser are considered to be covered by an existing location
+	sameLocationRadiusKm = 20
+	// defaultMaxDynamicLocations is the default of MAX_DYNAMIC_LOCATIONS
+	defaultMaxDynamicLocations = 100
+	// defaultDynamicLocationRetentionDays is the default of DYNAMIC_LOCATION_RETENTION_DAYS
+	defaultDynamicLocationRetentionDays = 7
+)
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// foldReplacer replaces letters that are not decomposed into a base letter and a combining mark by NFD.
+var foldReplacer = strings.NewReplacer("ł", "l", "ø", "o", "đ", "d", "ß", "ss", "æ", "ae", "œ", "oe", "ı", "i", "þ", "th")
+
+// place is an entry of the gazetteer
+type place struct {
+	// geonameID is 0 for places that are not from GeoNames
+	geonameID int
+	// key is the location key that the place gets when it is added as a location
+	key         string
+	name        string
+	countryCode string
+	lat         float32
+	lon         float32
+	timezone    string
+	population  int
+	// searchNames are the folded name, ascii name, and alternate names of the place
+	searchNames []string
+}
+
+// gazetteer is an in-memory list of places that can be searched by name
+type gazetteer struct {
+	places []*place
+	byKey  map[string]*place
+}
+
+// searchResult is an entry of the response of GET /api/locations/search
+type searchResult struct {
+	// Key is the key to pass to POST /api/locations to add the place as a location
+	Key         string  `json:"key"`
+	Name        string  `json:"name"`
+	CountryCode string  `json:"countryCode"`
+	Lat         float32 `json:"lat"`
+	Lon         float32 `json:"lon"`
+	Timezone    string  `json:"timezone"`
+	Population  int     `json:"population"`
+	// Location is the key of the supported location that covers the place, if there is one
+	Location string `json:"location,omitempty"`
+}
+
+// createLocationRequest is the request body of POST /api/locations
+type createLocationRequest struct {
+	// Key is the key of a place in the gazetteer
+	Key string `json:"key"`
+}
+
+// placeMatch is a place that matched a search query
+type placeMatch struct {
+	place *place
+	// score ranks matches, lower is better
+	score int
+}
+
+// loadGazetteer loads every place list in gazetteerDir.
+// Places that appear in several lists are only kept once.
+func loadGazetteer() (*gazetteer, error) {
+	g := &gazetteer{byKey: map[string]*place{}}
+
+	entries, err := fs.ReadDir(gazetteerDir, "gazetteer")
+	if err != nil {
+		return nil, err
+	}
+
+	type placeID struct {
+		name        string
+		countryCode string
+	}
+	seen := map[placeID]bool{}
+
+	// the largest list is loaded first, so that its entries win over duplicates in smaller lists
+	var lists [][]*place
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
+			continue
+		}
+		b, err := gazetteerDir.ReadFile("gazetteer/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		places, err := parseGeoNames(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gazetteer %v: %w", e.Name(), err)
+		}
+		lists = append(lists, places)
+	}
+	slices.SortFunc(lists, func(a, b []*place) int {
+		return cmp.Compare(len(b), len(a))
+	})
+
+	for i, places := range lists {
+		for _, p := range places {
+			id := placeID{foldName(p.name), p.countryCode}
+			if i > 0 && seen[id] {
+				continue
+			}
+			seen[id] = true
+			g.places = append(g.places, p)
+		}
+	}
+
+	// more populous places get the shorter key if several places share a name
+	slices.SortStableFunc(g.places, func(a, b *place) int {
+		return cmp.Compare(b.population, a.population)
+	})
+	for i, p := range g.places {
+		key := slugify(p.name) + "-" + strings.ToLower(p.countryCode)
+		if _, ok := g.byKey[key]; ok {
+			if p.geonameID != 0 {
+				key = fmt.Sprintf("%v-%d", key, p.geonameID)
+			} else {
+				key = fmt.Sprintf("%v-%d", key, i)
+			}
+		}
+		p.key = key
+		g.byKey[key] = p
+	}
+
+	return g, nil
+}
+
+// parseGeoNames parses a tab separated place list in the GeoNames dump format.
+func parseGeoNames(b []byte) ([]*place, error) {
+	var places []*place
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) < 18 {
+			continue
+		}
+
+		lat, err := strconv.ParseFloat(cols[4], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latitude on line %d: %w", line, err)
+		}
+		lon, err := strconv.ParseFloat(cols[5], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid longitude on line %d: %w", line, err)
+		}
+		geonameID, _ := strconv.Atoi(cols[0])
+		population, _ := strconv.Atoi(cols[14])
+
+		p := &place{
+			geonameID:   geonameID,
+			name:        cols[1],
+			countryCode: cols[8],
+			lat:         float32(lat),
+			lon:         float32(lon),
+			timezone:    cols[17],
+			population:  population,
+		}
+
+		names := []string{cols[1], cols[2]}
+		if cols[3] != "" {
+			names = append(names, strings.Split(cols[3], ",")...)
+		}
+		for _, n := range names {
+			if f := foldName(n); f != "" && !slices.Contains(p.searchNames, f) {
+				p.searchNames = append(p.searchNames, f)
+			}
+		}
+
+		places = append(places, p)
+	}
+
+	return places, scanner.Err()
+}
+
+// search returns the places whose names start with, contain, or are a slight misspelling of query,
+// ordered by how well they match, then by population.
+func (g *gazetteer) search(query string) []placeMatch {
+	q := foldName(query)
+	if q == "" {
+		return nil
+	}
+
+	maxDistance := 0
+	if len([]rune(q)) >= minFuzzyQueryLength {
+		maxDistance = 1 + len([]rune(q))/8
+	}
+
+	var matches []placeMatch
+	for _, p := range g.places {
+		if score, ok := matchPlace(p, q, maxDistance); ok {
+			matches = append(matches, placeMatch{p, score})
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b placeMatch) int {
+		if c := cmp.Compare(a.score, b.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.place.population, a.place.population)
+	})
+
+	return matches[:min(len(matches), maxSearchResults)]
+}
+
+// matchPlace returns the best score of the names of p for the folded query q.
+func matchPlace(p *place, q string, maxDistance int) (int, bool) {
+	best := -1
+	for _, n := range p.searchNames {
+		score := -1
+		switch {
+		case n == q:
+			score = 0
+		case strings.HasPrefix(n, q):
+			score = 1
+		case strings.Contains(n, q):
+			score = 2
+		case maxDistance > 0:
+			// compare against a prefix of the name, so that partially typed names are matched too
+			r := []rune(n)
+			d := levenshtein(q, string(r[:min(len(r), len([]rune(q)))]))
+			if d <= maxDistance {
+				score = 2 + d
+			}
+		}
+		if score >= 0 && (best < 0 || score < best) {
+			best = score
+		}
+	}
+	return best, best >= 0
+}
+
+// distanceKm returns the great-circle distance between two coordinates in kilometers.
+func distanceKm(lat1, lon1, lat2, lon2 float32) float64 {
+	const earthRadiusKm = 6371
+	toRad := func(deg float32) float64 { return float64(deg) * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// foldName lowercases s and strips accents, so that "Kraków" and "krakow" compare equal.
+func foldName(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, strings.ToLower(strings.TrimSpace(s)))
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(s))
+	}
+	return foldReplacer.Replace(folded)
+}
+
+func slugify(s string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(foldName(s), "-"), "-")
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// parseMaxDynamicLocations parses MAX_DYNAMIC_LOCATIONS. 0 disables adding locations from the gazetteer.
+func parseMaxDynamicLocations(s string) (int, error) {
+	if s == "" {
+		return defaultMaxDynamicLocations, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("MAX_DYNAMIC_LOCATIONS must be a non-negative integer, got %q", s)
+	}
+	return n, nil
+}
+
+// parseDynamicLocationRetention parses DYNAMIC_LOCATION_RETENTION_DAYS. 0 keeps dynamic locations without subscribers forever.
+func parseDynamicLocationRetention(s string) (time.Duration, error) {
+	days := defaultDynamicLocationRetentionDays
+	if s != "" {
+		var err error
+		days, err = strconv.Atoi(s)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("DYNAMIC_LOCATION_RETENTION_DAYS must be a non-negative integer, got %q", s)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// nearestSupportedLocation returns the key of the supported location closest to p,
+// if there is one within sameLocationRadiusKm.
+func nearestSupportedLocation(p *place) (string, bool) {
+	if _, ok := supportedLocations()[p.key]; ok {
+		return p.key, true
+	}
+
+	nearest, d, ok := nearestLocation(p.lat, p.lon)
+	if !ok || d > sameLocationRadiusKm {
+		return "", false
+	}
+	return nearest, true
+}
+
+func handleLocationSearch(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		q := strings.TrimSpace(request.URL.Query().Get("q"))
+		if utf8.RuneCountInString(q) < minSearchQueryLength {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest,
+				fmt.Sprintf("q must be at least %d characters long", minSearchQueryLength), nil)
+			return
+		}
+
+		results := []searchResult{}
+		for _, m := range state.gazetteer.search(q) {
+			r := searchResult{
+				Key:         m.place.key,
+				Name:        m.place.name,
+				CountryCode: m.place.countryCode,
+				Lat:         m.place.lat,
+				Lon:         m.place.lon,
+				Timezone:    m.place.timezone,
+				Population:  m.place.population,
+			}
+			if locKey, ok := nearestSupportedLocation(m.place); ok {
+				r.Location = locKey
+			}
+			results = append(results, r)
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(results)
+	}
+}
+
+func handleCreateLocation(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
+
+		defer request.Body.Close()
+
+		body := createLocationRequest{}
+		err := json.NewDecoder(request.Body).Decode(&body)
+		if err != nil {
+			writeRequestBodyError(writer, err)
+			return
+		}
+
+		p, ok := state.gazetteer.byKey[body.Key]
+		if !ok {
+			writeError(writer, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("no place with key %q", body.Key), nil)
+			return
+		}
+
+		// a place that is already covered by a location does not need a new one
+		if locKey, ok := nearestSupportedLocation(p); ok {
+			writeLocation(writer, state, http.StatusOK, locKey)
+			return
+		}
+
+		created, err := createDynamicLocation(state, &locationConfig{
+			Key:      p.key,
+			Name:     p.name,
+			Lat:      p.lat,
+			Lon:      p.lon,
+			Timezone: p.timezone,
+		})
+		if errors.Is(err, errDynamicLocationLimit) {
+			writeError(writer, http.StatusConflict, errCodeConflict, err.Error(), nil)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to add location", "location", p.key, "error", err)
+			writeInternalError(writer)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			logger.Info("location added", "location", p.key)
+			status = http.StatusCreated
+		}
+		writeLocation(writer, state, status, p.key)
+	}
+}
+
+// writeLocation responds with the supported location with the given key.
+func writeLocation(writer http.ResponseWriter, state *state, status int, locKey string) {
+	loc, ok := lookupLocation(locKey)
+	if !ok {
+		writeError(writer, http.StatusNotFound, errCodeUnknownLocation, "unknown location "+locKey, nil)
+		return
+	}
+
+	state.subscriptionsMutex.Lock()
+	l := newAPILocation(state, locKey, loc)
+	state.subscriptionsMutex.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(l)
+}
+
+// nearestPlace returns the place closest to the given coordinates, and its distance in kilometers.
+func (g *gazetteer) nearestPlace(lat, lon float32) (*place, float64) {
+	var nearest *place
+	nearestDistance := math.Inf(1)
+	for _, p := range g.places {
+		if d := distanceKm(lat, lon, p.lat, p.lon); d < nearestDistance {
+			nearest, nearestDistance = p, d
+		}
+	}
+	return nearest, nearestDistance
+}
+
+// largestPlaceWithin returns the most populous place within radiusKm of the given coordinates,
+// or the closest one if their population is unknown.
+func (g *gazetteer) largestPlaceWithin(lat, lon float32, radiusKm float64) *place {
+	var largest *place
+	largestDistance := math.Inf(1)
+	for _, p := range g.places {
+		d := distanceKm(lat, lon, p.lat, p.lon)
+		if d > radiusKm {
+			continue
+		}
+		if largest == nil || p.population > largest.population || (p.population == largest.population && d < largestDistance) {
+			largest, largestDistance = p, d
+		}
+	}
+	return largest
+}
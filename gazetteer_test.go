@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGazetteerSearch(t *testing.T) {
+	g, err := loadGazetteer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		key   string
+	}{
+		{"Krakow", "krakow-pl"},
+		{"Kraków", "krakow-pl"},
+		{"krak", "krakow-pl"},
+		// alternate names
+		{"Cracow", "krakow-pl"},
+		{"Breslau", "wroclaw-pl"},
+		// a typo within the allowed distance
+		{"Krakuw", "krakow-pl"},
+		{"Wroclav", "wroclaw-pl"},
+	} {
+		matches := g.search(tc.query)
+		if len(matches) == 0 {
+			t.Errorf("%q found nothing", tc.query)
+			continue
+		}
+		if got := matches[0].place.key; got != tc.key {
+			t.Errorf("%q found %v first, expected %v", tc.query, got, tc.key)
+		}
+	}
+
+	// short queries are not matched fuzzily
+	for _, m := range g.search("Krk") {
+		if m.place.key == "krakow-pl" {
+			t.Error("\"Krk\" matched Kraków")
+		}
+	}
+
+	if p := g.byKey["krakow-pl"]; p == nil || p.name != "Kraków" || p.timezone != "Europe/Warsaw" {
+		t.Errorf("unexpected place for krakow-pl: %+v", p)
+	}
+}
+
+func TestGazetteerTimezones(t *testing.T) {
+	g, err := loadGazetteer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range g.places {
+		if _, err := time.LoadLocation(p.timezone); err != nil {
+			t.Errorf("%v has an invalid timezone: %v", p.key, err)
+		}
+	}
+}
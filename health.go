@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// staleSummaryAge is the age after which a summary is considered stale.
+// summaries are updated daily, so this allows a couple of hours of slack for a delayed update.
+const staleSummaryAge = 26 * time.Hour
+
+// healthCheck is the result of a single check of /healthz or /readyz
+type healthCheck struct {
+	Status string `json:"status"`
+	// Locations lists the location keys that failed the check, if applicable
+	Locations []string `json:"locations,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// healthResponse is the response body of /healthz and /readyz
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// handleHealthz reports whether the server is healthy.
+// The server is degraded if any summary is stale, or if any push listener has stopped.
+// Dynamic locations only count towards stale summaries once they have had a summary.
+func handleHealthz(state *state, writer http.ResponseWriter) {
+	var stale, deadListeners []string
+
+	configured := listConfiguredLocations()
+	state.locationStatusesMutex.Lock()
+	for locKey := range supportedLocations() {
+		status, ok := state.locationStatuses[locKey]
+		_, isConfigured := configured[locKey]
+		neverUpdated := !ok || status.lastUpdated.IsZero()
+		// anyone can add a dynamic location, so one whose first summary failed must not degrade the server
+		if (neverUpdated && isConfigured) || (!neverUpdated && time.Since(status.lastUpdated) > staleSummaryAge) {
+			stale = append(stale, locKey)
+		}
+		if !ok || !status.listenerRunning {
+			deadListeners = append(deadListeners, locKey)
+		}
+	}
+	state.locationStatusesMutex.Unlock()
+
+	writeHealthResponse(writer, "degraded", map[string]healthCheck{
+		"summaries":     newHealthCheck("stale", stale),
+		"pushListeners": newHealthCheck("dead", deadListeners),
+	})
+}
+
+// handleReadyz reports whether the server is ready to serve requests,
+// which means that the database is reachable, every location has a summary, and the schedulers are running.
+// Dynamic locations without a summary do not make the server unready, since anyone can add them,
+// and a replica must not be taken out of rotation because the first summary of one could not be generated.
+func handleReadyz(state *state, writer http.ResponseWriter, request *http.Request) {
+	checks := map[string]healthCheck{}
+
+	ctx, cancel := context.WithTimeout(request.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := state.db.PingContext(ctx); err != nil {
+		checks["database"] = healthCheck{Status: "unreachable", Error: err.Error()}
+	} else {
+		checks["database"] = healthCheck{Status: "ok"}
+	}
+
+	var missing, notScheduled []string
+	configured := listConfiguredLocations()
+	for locKey := range supportedLocations() {
+		if _, ok := state.summaries.Load(locKey); !ok {
+			if _, isConfigured := configured[locKey]; isConfigured {
+				missing = append(missing, locKey)
+			}
+		}
+
+		job, ok := scheduledJob(state, locKey)
+		if !ok || !state.schedulersRunning.Load() {
+			notScheduled = append(notScheduled, locKey)
+		} else if t, err := job.NextRun(); err != nil || t.IsZero() {
+			notScheduled = append(notScheduled, locKey)
+		}
+	}
+
+	checks["summaries"] = newHealthCheck("missing", missing)
+	checks["schedulers"] = newHealthCheck("not running", notScheduled)
+
+	writeHealthResponse(writer, "not ready", checks)
+}
+
+// newHealthCheck creates a passing check if failed is empty, or a check with the given status otherwise.
+func newHealthCheck(status string, failed []string) healthCheck {
+	if len(failed) == 0 {
+		return healthCheck{Status: "ok"}
+	}
+	slices.Sort(failed)
+	return healthCheck{Status: status, Locations: failed}
+}
+
+// writeHealthResponse responds with 200 if all checks pass, or 503 with failedStatus as the overall status otherwise.
+func writeHealthResponse(writer http.ResponseWriter, failedStatus string, checks map[string]healthCheck) {
+	res := healthResponse{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if c.Status != "ok" {
+			res.Status = failedStatus
+			break
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if res.Status != "ok" {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(writer).Encode(res)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecksIgnoreDynamicLocationsWithoutSummary(t *testing.T) {
+	state := newTestState(t)
+
+	for locKey := range listConfiguredLocations() {
+		state.summaries.Store(locKey, "It is sunny today.")
+		state.locationStatuses[locKey] = &locationStatus{lastUpdated: time.Now(), listenerRunning: true}
+	}
+
+	c := &locationConfig{Key: "grid-n5000-e01975", Name: "Kraków", Lat: 50, Lon: 19.75, Timezone: "Europe/Warsaw"}
+	loc, err := c.toLocation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDynamicLocation(c.Key, loc)
+	t.Cleanup(func() {
+		locationsMutex.Lock()
+		delete(dynamicLocations, c.Key)
+		mergeLocations()
+		locationsMutex.Unlock()
+	})
+	state.locationStatuses[c.Key] = &locationStatus{listenerRunning: true}
+
+	summariesCheck := func(handle func(writer http.ResponseWriter)) healthCheck {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handle(rec)
+		res := healthResponse{}
+		err := json.NewDecoder(rec.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Checks["summaries"]
+	}
+	healthz := func(writer http.ResponseWriter) { handleHealthz(state, writer) }
+	readyz := func(writer http.ResponseWriter) {
+		handleReadyz(state, writer, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	}
+
+	if c := summariesCheck(healthz); c.Status != "ok" {
+		t.Errorf("healthz reports summaries %+v", c)
+	}
+	if c := summariesCheck(readyz); c.Status != "ok" {
+		t.Errorf("readyz reports summaries %+v", c)
+	}
+
+	// once it has a summary, a dynamic location is checked like any other
+	state.locationStatuses[c.Key].lastUpdated = time.Now().Add(-2 * staleSummaryAge)
+	if c := summariesCheck(healthz); c.Status != "stale" || len(c.Locations) != 1 || c.Locations[0] != "grid-n5000-e01975" {
+		t.Errorf("healthz reports summaries %+v", c)
+	}
+
+	// a location of the locations file without a summary is never ignored
+	state.summaries.Delete("london")
+	if c := summariesCheck(readyz); c.Status != "missing" || len(c.Locations) != 1 || c.Locations[0] != "london" {
+		t.Errorf("readyz reports summaries %+v", c)
+	}
+}
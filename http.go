@@ -0,0 +1,507 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// middleware wraps a handler to add behavior before and/or after it.
+type middleware func(next http.Handler) http.Handler
+
+type contextKey int
+
+const (
+	requestIDContextKey contextKey = iota
+)
+
+// codes of errors returned by the api
+const (
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeRequestTooLarge     = "request_too_large"
+	errCodeInvalidSubscription = "invalid_subscription"
+	errCodeUnknownLocation     = "unknown_location"
+	errCodeNotFound            = "not_found"
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeUnauthorized        = "unauthorized"
+	errCodeForbidden           = "forbidden"
+	errCodeConflict            = "conflict"
+	errCodeRateLimited         = "rate_limited"
+	errCodeUpstreamFailed      = "upstream_failed"
+	errCodeInternal            = "internal_error"
+)
+
+// apiError describes why a request failed.
+type apiError struct {
+	// Code is a machine-readable error code, one of the errCode* constants
+	Code string `json:"code"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+	// Details is optional, and depends on Code
+	Details any `json:"details,omitempty"`
+}
+
+// errorResponse is the response body of every failed api request
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// validRequestID matches request ids that are accepted from clients or proxies via X-Request-ID.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// compressibleTypes lists the content types that are gzipped when the client accepts it.
+var compressibleTypes = []string{"text/html", "text/css", "text/plain", "text/javascript", "application/javascript", "application/json", "application/manifest+json"}
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// pagePattern is the route of the pages of locations, which matches every path that no other route matches
+const pagePattern = "GET /{path...}"
+
+// newRouter creates the http handler of the server.
+func newRouter(state *state) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", handleIndex(state))
+	mux.HandleFunc("GET /instructions", handleInstructions)
+	mux.HandleFunc("GET /vapid", handleVAPIDPublicKey(state))
+
+	// creating a location generates a summary every day, which is limited more strictly than registrations.
+	// the limiter is shared by every endpoint that can create a location.
+	locationLimiter := newRateLimiter(locationRateLimit, locationRateBurst)
+
+	registrationLimiter := newRateLimiter(registrationRateLimit, registrationRateBurst)
+	mux.HandleFunc("POST /registrations", rateLimit(state, registrationLimiter, limitBody(maxRegistrationBodySize, handleCreateRegistration(state, locationLimiter))))
+	mux.HandleFunc("PATCH /registrations/{id}", rateLimit(state, registrationLimiter, limitBody(maxRegistrationBodySize, handleUpdateRegistration(state, locationLimiter))))
+	mux.HandleFunc("DELETE /registrations/{id}", rateLimit(state, registrationLimiter, limitBody(maxRegistrationBodySize, handleDeleteRegistration(state))))
+
+	if state.mailer != nil {
+		emailLimiter := newRateLimiter(emailRateLimit, emailRateBurst)
+		mux.HandleFunc("POST /email/subscriptions", rateLimit(state, emailLimiter, limitBody(maxEmailBodySize, handleCreateEmailSubscription(state))))
+		mux.HandleFunc("GET /email/confirm", handleConfirmEmailSubscription(state))
+		mux.HandleFunc("POST /email/confirm", handleConfirmEmailSubscription(state))
+		mux.HandleFunc("GET /email/unsubscribe", handleEmailUnsubscribe(state))
+		mux.HandleFunc("POST /email/unsubscribe", handleEmailUnsubscribe(state))
+	}
+
+	mux.HandleFunc("GET /api/locations", handleLocationsAPI(state))
+	mux.HandleFunc("GET /api/locations/search", handleLocationSearch(state))
+
+	mux.HandleFunc("POST /api/locations", rateLimit(state, locationLimiter, limitBody(maxLocationBodySize, handleCreateLocation(state))))
+	mux.HandleFunc("POST /api/locations/nearest", limitBody(maxLocationBodySize, handleNearestLocation(state, locationLimiter)))
+	mux.HandleFunc("GET /api/summary/{loc}", handleSummaryAPI(state))
+
+	mux.HandleFunc("GET /healthz", func(writer http.ResponseWriter, request *http.Request) {
+		handleHealthz(state, writer)
+	})
+	mux.HandleFunc("GET /readyz", func(writer http.ResponseWriter, request *http.Request) {
+		handleReadyz(state, writer, request)
+	})
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	registerAdminRoutes(mux, state)
+
+	mux.HandleFunc(pagePattern, handlePage(state))
+
+	return chainMiddleware(withJSONRoutingErrors(mux),
+		requestIDMiddleware,
+		newAccessLogMiddleware(state.trustedProxies),
+		recoveryMiddleware,
+		newCORSMiddleware(mux),
+		compressionMiddleware,
+	)
+}
+
+// withJSONRoutingErrors responds to requests that match no route of mux with an error response body,
+// instead of the plain text 404 and 405 responses of ServeMux.
+func withJSONRoutingErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler, pattern := mux.Handler(request)
+		if pattern != "" {
+			mux.ServeHTTP(writer, request)
+			return
+		}
+
+		// the handler of an unmatched request only sets the status, and the Allow header for 405
+		rec := &routingErrorRecorder{header: http.Header{}}
+		handler.ServeHTTP(rec, request)
+
+		if rec.status == http.StatusMethodNotAllowed {
+			writer.Header()["Allow"] = rec.header["Allow"]
+			writeError(writer, http.StatusMethodNotAllowed, errCodeMethodNotAllowed,
+				fmt.Sprintf("method %v is not allowed for %v", request.Method, request.URL.Path), nil)
+			return
+		}
+		writeError(writer, http.StatusNotFound, errCodeNotFound, "not found", nil)
+	})
+}
+
+// routingErrorRecorder records the status and header written by the handler of an unmatched request, and discards its body.
+type routingErrorRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *routingErrorRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *routingErrorRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *routingErrorRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+// chainMiddleware wraps handler with the given middlewares. The first middleware is the outermost one.
+func chainMiddleware(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// requestLogger returns a logger that tags every record with the id of the request.
+func requestLogger(request *http.Request) *slog.Logger {
+	return slog.With("requestID", requestIDFromContext(request.Context()))
+}
+
+// requestIDFromContext returns the id of the request that ctx belongs to, or an empty string if there is none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestIDMiddleware assigns an id to every request, which is echoed in the X-Request-ID response header.
+// A well-formed X-Request-ID request header is reused, so that the id can be correlated with upstream proxies.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		writer.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(request.Context(), requestIDContextKey, id)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// statusRecorder records the status code and the number of body bytes written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// newAccessLogMiddleware creates a middleware that logs every request after it is handled.
+// X-Forwarded-For is only honored for requests coming from one of trustedProxies.
+func newAccessLogMiddleware(trustedProxies []netip.Prefix) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: writer}
+
+			next.ServeHTTP(rec, request)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			requestLogger(request).Info("http request",
+				"method", request.Method,
+				"path", request.URL.Path,
+				"status", rec.status,
+				"duration", time.Since(start),
+				"bytes", rec.bytes,
+				"remoteIP", clientIP(request, trustedProxies),
+			)
+		})
+	}
+}
+
+// parseTrustedProxies parses a comma separated list of ip addresses and cidr ranges.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %v: %w", p, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		} else {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %v: %w", p, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	addr = addr.Unmap()
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// clientIP returns the ip address of the client that sent the request.
+// If the request comes from a trusted proxy, X-Forwarded-For is walked from right to left,
+// and the first address that is not a trusted proxy is returned.
+func clientIP(request *http.Request, trustedProxies []netip.Prefix) string {
+	remote, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+
+	ip := remote.Addr().Unmap()
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip.String()
+	}
+
+	var forwarded []string
+	for _, h := range request.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap()
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// writeError responds with the given status and an error response body.
+func writeError(writer http.ResponseWriter, status int, code string, message string, details any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(errorResponse{apiError{code, message, details}})
+}
+
+// writeInternalError responds with 500. The actual error is not exposed to the client and should be logged instead.
+func writeInternalError(writer http.ResponseWriter) {
+	writeError(writer, http.StatusInternalServerError, errCodeInternal, "internal server error", nil)
+}
+
+// writeRequestBodyError responds to a request whose body failed to decode with err.
+func writeRequestBodyError(writer http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(writer, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge,
+			fmt.Sprintf("request body must not be larger than %d bytes", maxBytesErr.Limit), nil)
+		return
+	}
+	writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, "invalid request body: "+err.Error(), nil)
+}
+
+// recoveryMiddleware turns a panicking handler into a 500 response instead of a dropped connection.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+
+			requestLogger(request).Error("http handler panicked",
+				"method", request.Method,
+				"path", request.URL.Path,
+				"panic", fmt.Sprint(r),
+				"stack", string(debug.Stack()),
+			)
+			writeInternalError(writer)
+		}()
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// newCORSMiddleware allows the public api under /api/ to be called from any origin.
+// Preflight requests are answered with the methods that mux has a route for.
+func newCORSMiddleware(mux *http.ServeMux) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if !strings.HasPrefix(request.URL.Path, "/api/") {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			if origin := request.Header.Get("Origin"); origin != "" {
+				writer.Header().Set("Access-Control-Allow-Origin", origin)
+				writer.Header().Add("Vary", "Origin")
+			}
+
+			if request.Method == http.MethodOptions {
+				writer.Header().Set("Access-Control-Allow-Methods", strings.Join(routeMethods(mux, request), ", "))
+				// the api only reads Content-Type, but browsers also ask for headers that the page sets itself
+				writer.Header().Set("Access-Control-Allow-Headers", cmp.Or(request.Header.Get("Access-Control-Request-Headers"), "Content-Type"))
+				writer.Header().Add("Vary", "Access-Control-Request-Headers")
+				writer.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// routeMethods returns the methods that mux has a route for at the path of request, followed by OPTIONS.
+// The catch-all page route is ignored, since it matches every path.
+func routeMethods(mux *http.ServeMux, request *http.Request) []string {
+	var methods []string
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		r := request.Clone(request.Context())
+		r.Method = method
+		if _, pattern := mux.Handler(r); pattern != "" && pattern != pagePattern {
+			methods = append(methods, method)
+		}
+	}
+	return append(methods, http.MethodOptions)
+}
+
+// gzipResponseWriter gzips the response body if the response has a compressible content type.
+// Whether to compress is decided when the header is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	compress    bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	if status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.compress = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.compress {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if w.gz == nil {
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close flushes the gzip stream, if any.
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriterPool.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+func isCompressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(compressibleTypes, t)
+}
+
+// compressionMiddleware gzips responses for clients that accept it.
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") || request.Method == http.MethodHead {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: writer}
+		defer gw.close()
+
+		next.ServeHTTP(gw, request)
+	})
+}
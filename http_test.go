@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := func(writer http.ResponseWriter, request *http.Request) {}
+	mux.HandleFunc("GET /api/locations", ok)
+	mux.HandleFunc("POST /api/locations", ok)
+	mux.HandleFunc("POST /api/locations/nearest", ok)
+	mux.HandleFunc("DELETE /api/things/{id}", ok)
+	mux.HandleFunc(pagePattern, ok)
+	handler := newCORSMiddleware(mux)(mux)
+
+	for _, tc := range []struct {
+		path           string
+		requestHeaders string
+		methods        string
+		headers        string
+	}{
+		{"/api/locations", "", "GET, POST, OPTIONS", "Content-Type"},
+		{"/api/locations/nearest", "content-type", "POST, OPTIONS", "content-type"},
+		{"/api/things/42", "content-type, x-request-id", "DELETE, OPTIONS", "content-type, x-request-id"},
+	} {
+		request := httptest.NewRequest(http.MethodOptions, tc.path, nil)
+		request.Header.Set("Origin", "https://example.com")
+		request.Header.Set("Access-Control-Request-Method", "POST")
+		if tc.requestHeaders != "" {
+			request.Header.Set("Access-Control-Request-Headers", tc.requestHeaders)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, request)
+
+		h := rec.Header()
+		if rec.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://example.com" {
+			t.Errorf("%v: preflight responded with %v, origin %q", tc.path, rec.Code, h.Get("Access-Control-Allow-Origin"))
+		}
+		if got := h.Get("Access-Control-Allow-Methods"); got != tc.methods {
+			t.Errorf("%v: allowed methods are %q, expected %q", tc.path, got, tc.methods)
+		}
+		if got := h.Get("Access-Control-Allow-Headers"); got != tc.headers {
+			t.Errorf("%v: allowed headers are %q, expected %q", tc.path, got, tc.headers)
+		}
+	}
+
+	// pages are not part of the api
+	rec := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/london", nil)
+	request.Header.Set("Origin", "https://example.com")
+	handler.ServeHTTP(rec, request)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("page allows origin %q", got)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed locations.yaml
+var defaultLocationsFile []byte
+
+// defaultDeliveryTime is when summaries are pushed if a location does not specify a delivery time
+const defaultDeliveryTime = "07:00"
+
+// errDynamicLocationLimit is returned when a location is added while MAX_DYNAMIC_LOCATIONS has been reached
+var errDynamicLocationLimit = errors.New("no more locations can be added")
+
+// dynamicLocationPruneInterval is how often dynamic locations without subscribers are looked for
+const dynamicLocationPruneInterval = time.Hour
+
+// validLocationKey matches location keys, which are used as the path of summary pages.
+var validLocationKey = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// reservedLocationKeys are paths that are taken by other pages or endpoints
+var reservedLocationKeys = []string{"instructions", "vapid", "registrations", "api", "admin", "healthz", "readyz", "metrics", "email"}
+
+var (
+	// locationsMutex guards configuredLocations, dynamicLocations, and activeLocations
+	locationsMutex sync.RWMutex
+	// configuredLocations maps location keys to the enabled locations of the locations file
+	configuredLocations map[string]*location
+	// dynamicLocations maps location keys to the locations that were added from the gazetteer at runtime
+	dynamicLocations = map[string]*location{}
+	// activeLocations is the union of configuredLocations and dynamicLocations.
+	// the map is replaced as a whole when either changes, and is never modified in place.
+	activeLocations map[string]*location
+)
+
+// locationsFile is the format of the locations file
+type locationsFile struct {
+	Locations []locationConfig `yaml:"locations"`
+}
+
+// locationConfig is an entry of the locations file
+type locationConfig struct {
+	Key      string  `yaml:"key"`
+	Name     string  `yaml:"name"`
+	Lat      float32 `yaml:"lat"`
+	Lon      float32 `yaml:"lon"`
+	Timezone string  `yaml:"timezone"`
+	// DeliveryTime is the local time as HH:MM at which the summary is pushed
+	DeliveryTime string `yaml:"deliveryTime"`
+	// Enabled defaults to true
+	Enabled *bool `yaml:"enabled"`
+	// Units and Language override PROMPT_UNITS and PROMPT_LANGUAGE for the location
+	Units    string `yaml:"units"`
+	Language string `yaml:"language"`
+}
+
+// apiLocation is an entry of the response of GET /api/locations
+type apiLocation struct {
+	Key      string  `json:"key"`
+	Name     string  `json:"name"`
+	Lat      float32 `json:"lat"`
+	Lon      float32 `json:"lon"`
+	Timezone string  `json:"timezone"`
+	// NextDelivery is when the next summary is scheduled to be pushed, or null if the location is not scheduled
+	NextDelivery *time.Time `json:"nextDelivery"`
+	Subscribers  int        `json:"subscribers"`
+}
+
+// indexTemplateData stores template data for index.html
+type indexTemplateData struct {
+	Locations []indexLocation
+}
+
+// indexLocation is a link to a summary page on the index page
+type indexLocation struct {
+	Key  string
+	Name string
+}
+
+// supportedLocations returns the enabled locations keyed by location key.
+// The returned map must not be modified.
+func supportedLocations() map[string]*location {
+	locationsMutex.RLock()
+	defer locationsMutex.RUnlock()
+	return activeLocations
+}
+
+// listConfiguredLocations returns the enabled locations of the locations file keyed by location key,
+// which leaves out the locations that were added from the gazetteer. The returned map must not be modified.
+func listConfiguredLocations() map[string]*location {
+	locationsMutex.RLock()
+	defer locationsMutex.RUnlock()
+	return configuredLocations
+}
+
+// lookupLocation returns the enabled location with the given key.
+func lookupLocation(locKey string) (*location, bool) {
+	loc, ok := supportedLocations()[locKey]
+	return loc, ok
+}
+
+// setConfiguredLocations replaces the locations of the locations file.
+func setConfiguredLocations(locs map[string]*location) {
+	locationsMutex.Lock()
+	configuredLocations = locs
+	mergeLocations()
+	locationsMutex.Unlock()
+}
+
+// addDynamicLocation adds a location from the gazetteer to the supported locations.
+func addDynamicLocation(locKey string, loc *location) {
+	locationsMutex.Lock()
+	dynamicLocations[locKey] = loc
+	mergeLocations()
+	locationsMutex.Unlock()
+}
+
+// dynamicLocationCount returns the number of locations that were added from the gazetteer.
+func dynamicLocationCount() int {
+	locationsMutex.RLock()
+	defer locationsMutex.RUnlock()
+	return len(dynamicLocations)
+}
+
+// mergeLocations rebuilds activeLocations. A configured location wins over a dynamic location with the same key.
+// locationsMutex must be held.
+func mergeLocations() {
+	locs := maps.Clone(dynamicLocations)
+	maps.Copy(locs, configuredLocations)
+	activeLocations = locs
+}
+
+// loadDynamicLocations loads the locations that were added from the gazetteer in previous runs.
+// Locations that are no longer valid, for example because their time zone was removed from the tz database, are skipped.
+func loadDynamicLocations(db *sql.DB) error {
+	rows, err := db.Query("SELECT key, name, lat, lon, timezone FROM dynamic_locations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := locationConfig{}
+		err = rows.Scan(&c.Key, &c.Name, &c.Lat, &c.Lon, &c.Timezone)
+		if err != nil {
+			return err
+		}
+
+		loc, err := c.toLocation()
+		if err != nil {
+			slog.Warn("skipping invalid dynamic location", "location", c.Key, "error", err)
+			continue
+		}
+
+		addDynamicLocation(c.Key, loc)
+	}
+
+	return rows.Err()
+}
+
+// createDynamicLocation adds c as a dynamic location, schedules it, and generates its first summary.
+// created is false if a location with the same key already exists.
+// errDynamicLocationLimit is returned if MAX_DYNAMIC_LOCATIONS has been reached.
+func createDynamicLocation(state *state, c *locationConfig) (created bool, err error) {
+	state.dynamicLocationsMutex.Lock()
+
+	if _, ok := lookupLocation(c.Key); ok {
+		state.dynamicLocationsMutex.Unlock()
+		return false, nil
+	}
+
+	if dynamicLocationCount() >= state.maxDynamicLocations {
+		state.dynamicLocationsMutex.Unlock()
+		return false, errDynamicLocationLimit
+	}
+
+	loc, err := c.toLocation()
+	if err == nil {
+		err = saveDynamicLocation(state, c)
+	}
+	if err != nil {
+		state.dynamicLocationsMutex.Unlock()
+		return false, err
+	}
+
+	addDynamicLocation(c.Key, loc)
+	err = startLocation(state, c.Key, loc)
+	state.dynamicLocationsMutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	// registrations that were made before the location was removed resume
+	err = loadSubscriptions(state, []string{c.Key})
+	if err != nil {
+		slog.Warn("failed to load subscriptions of added location", "location", c.Key, "error", err)
+	}
+
+	// the summary page of the location is only available once it has a summary
+	fetchInitialSummary(state, c.Key, loc)
+
+	return true, nil
+}
+
+// saveDynamicLocation persists a location that was added from the gazetteer, so that it survives restarts.
+func saveDynamicLocation(state *state, c *locationConfig) error {
+	state.dbMutex.Lock()
+	defer state.dbMutex.Unlock()
+	_, err := state.db.Exec(
+		"INSERT INTO dynamic_locations (key, name, lat, lon, timezone, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		c.Key, c.Name, c.Lat, c.Lon, c.Timezone, time.Now().Unix(),
+	)
+	return err
+}
+
+// removeDynamicLocation removes a location that was added from the gazetteer, and stops its job.
+// Registrations that are subscribed to it are kept, and resume if the location is added again.
+// sql.ErrNoRows is returned if no dynamic location has the key.
+func removeDynamicLocation(state *state, locKey string) error {
+	state.dynamicLocationsMutex.Lock()
+	defer state.dynamicLocationsMutex.Unlock()
+
+	state.dbMutex.Lock()
+	res, err := state.db.Exec("DELETE FROM dynamic_locations WHERE key = ?", locKey)
+	state.dbMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	locationsMutex.Lock()
+	delete(dynamicLocations, locKey)
+	mergeLocations()
+	_, configured := configuredLocations[locKey]
+	locationsMutex.Unlock()
+
+	// a location of the locations file with the same key keeps running
+	if !configured {
+		stopRemovedLocation(state, locKey)
+	}
+
+	return nil
+}
+
+// pruneDynamicLocations removes the dynamic locations that have had no subscribers for state.dynamicLocationRetention.
+func pruneDynamicLocations(state *state) {
+	locationsMutex.RLock()
+	keys := slices.Collect(maps.Keys(dynamicLocations))
+	locationsMutex.RUnlock()
+
+	now := time.Now()
+	for _, locKey := range keys {
+		state.subscriptionsMutex.Lock()
+		subscribers := len(state.subscriptions[locKey])
+		state.subscriptionsMutex.Unlock()
+
+		state.dbMutex.Lock()
+		var unusedSince sql.NullInt64
+		var err error
+		if subscribers > 0 {
+			_, err = state.db.Exec("UPDATE dynamic_locations SET unused_since = NULL WHERE key = ?", locKey)
+		} else {
+			err = state.db.QueryRow(
+				"UPDATE dynamic_locations SET unused_since = coalesce(unused_since, ?) WHERE key = ? RETURNING unused_since",
+				now.Unix(), locKey,
+			).Scan(&unusedSince)
+		}
+		state.dbMutex.Unlock()
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Warn("failed to update the usage of dynamic location", "location", locKey, "error", err)
+			}
+			continue
+		}
+
+		if !unusedSince.Valid || now.Sub(time.Unix(unusedSince.Int64, 0)) < state.dynamicLocationRetention {
+			continue
+		}
+
+		err = removeDynamicLocation(state, locKey)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.Error("failed to remove unused dynamic location", "location", locKey, "error", err)
+			}
+			continue
+		}
+		slog.Info("removed dynamic location without subscribers", "location", locKey, "unusedSince", time.Unix(unusedSince.Int64, 0))
+	}
+}
+
+// pruneDynamicLocationsPeriodically calls pruneDynamicLocations every dynamicLocationPruneInterval until the server stops.
+func pruneDynamicLocationsPeriodically(state *state) {
+	ticker := time.NewTicker(dynamicLocationPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		pruneDynamicLocations(state)
+
+		select {
+		case <-ticker.C:
+		case <-state.ctx.Done():
+			return
+		}
+	}
+}
+
+// supportedLocationKeys returns the keys of the enabled locations in sorted order.
+func supportedLocationKeys() []string {
+	return slices.Sorted(maps.Keys(supportedLocations()))
+}
+
+// initLocations loads the locations file at path, or the built-in locations.yaml if path is empty,
+// and makes its locations the supported locations.
+func initLocations(path string) error {
+	locs, err := loadLocations(path)
+	if err != nil {
+		return err
+	}
+	setConfiguredLocations(locs)
+	return nil
+}
+
+// loadLocations reads and validates the locations file at path, or the built-in locations.yaml if path is empty.
+// Both yaml and json files are accepted. Disabled locations are left out of the returned map.
+func loadLocations(path string) (map[string]*location, error) {
+	b := defaultLocationsFile
+	if path != "" {
+		var err error
+		b, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read locations file: %w", err)
+		}
+	}
+
+	// json is valid yaml, so the yaml decoder handles both
+	f := locationsFile{}
+	err := yaml.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse locations file %v: %w", path, err)
+	}
+
+	locs := map[string]*location{}
+	seen := map[string]bool{}
+	for i, c := range f.Locations {
+		if seen[c.Key] {
+			return nil, fmt.Errorf("duplicate location key %q in locations file", c.Key)
+		}
+		seen[c.Key] = true
+
+		loc, err := c.toLocation()
+		if err != nil {
+			return nil, fmt.Errorf("invalid location #%d (%v) in locations file: %w", i+1, c.Key, err)
+		}
+
+		if c.Enabled == nil || *c.Enabled {
+			locs[c.Key] = loc
+		}
+	}
+
+	return locs, nil
+}
+
+func (c *locationConfig) toLocation() (*location, error) {
+	if !validLocationKey.MatchString(c.Key) {
+		return nil, errors.New("key must only contain lowercase letters, digits and dashes")
+	}
+	if slices.Contains(reservedLocationKeys, c.Key) {
+		return nil, fmt.Errorf("key %v is reserved", c.Key)
+	}
+	if c.Name == "" {
+		return nil, errors.New("name is missing")
+	}
+	if c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180 {
+		return nil, errors.New("coordinates are out of range")
+	}
+
+	tz, err := time.LoadLocation(c.Timezone)
+	if err != nil || c.Timezone == "" {
+		return nil, fmt.Errorf("unknown time zone %q", c.Timezone)
+	}
+
+	deliveryTime := c.DeliveryTime
+	if deliveryTime == "" {
+		deliveryTime = defaultDeliveryTime
+	}
+	t, err := time.Parse("15:04", deliveryTime)
+	if err != nil {
+		return nil, fmt.Errorf("delivery time must be HH:MM, got %q", c.DeliveryTime)
+	}
+
+	return &location{
+		tz:             tz,
+		lat:            c.Lat,
+		lon:            c.Lon,
+		ianaName:       c.Timezone,
+		displayName:    c.Name,
+		deliveryHour:   uint(t.Hour()),
+		deliveryMinute: uint(t.Minute()),
+		units:          c.Units,
+		language:       c.Language,
+	}, nil
+}
+
+// sameSchedule reports whether l and other have the same forecast and delivery schedule,
+// in which case the scheduled job of the location can be kept when the locations file is reloaded.
+func (l *location) sameSchedule(other *location) bool {
+	return l.lat == other.lat && l.lon == other.lon && l.ianaName == other.ianaName &&
+		l.deliveryHour == other.deliveryHour && l.deliveryMinute == other.deliveryMinute
+}
+
+// deliveryTime formats the local time at which the summary of l is pushed, e.g. "07:00".
+func (l *location) deliveryTime() string {
+	return fmt.Sprintf("%02d:%02d", l.deliveryHour, l.deliveryMinute)
+}
+
+// locationKeysByName returns the keys of locs, sorted by the display name of the locations.
+func locationKeysByName(locs map[string]*location) []string {
+	keys := slices.Sorted(maps.Keys(locs))
+	slices.SortStableFunc(keys, func(a, b string) int {
+		return cmp.Compare(locs[a].displayName, locs[b].displayName)
+	})
+	return keys
+}
+
+func handleIndex(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		locs := supportedLocations()
+		data := indexTemplateData{}
+		for _, locKey := range locationKeysByName(locs) {
+			data.Locations = append(data.Locations, indexLocation{locKey, locs[locKey].displayName})
+		}
+
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		state.template.index.Execute(writer, data)
+	}
+}
+
+// newAPILocation describes the location for the locations api. state.subscriptionsMutex must be held.
+func newAPILocation(state *state, locKey string, loc *location) apiLocation {
+	l := apiLocation{
+		Key:         locKey,
+		Name:        loc.displayName,
+		Lat:         loc.lat,
+		Lon:         loc.lon,
+		Timezone:    loc.ianaName,
+		Subscribers: len(state.subscriptions[locKey]),
+	}
+	if job, ok := scheduledJob(state, locKey); ok {
+		if t, err := job.NextRun(); err == nil && !t.IsZero() {
+			l.NextDelivery = &t
+		}
+	}
+	return l
+}
+
+func handleLocationsAPI(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		supported := supportedLocations()
+		locs := []apiLocation{}
+
+		state.subscriptionsMutex.Lock()
+		for _, locKey := range locationKeysByName(supported) {
+			locs = append(locs, newAPILocation(state, locKey, supported[locKey]))
+		}
+		state.subscriptionsMutex.Unlock()
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(locs)
+	}
+}
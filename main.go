@@ -10,21 +10,28 @@ import (
 	"flag"
 	"fmt"
 	"github.com/SherClockHolmes/webpush-go"
-	"github.com/go-co-op/gocron/v2"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/genai"
 	"html/template"
+	"io"
 	"log"
 	"log/slog"
 	"mime"
 	_ "modernc.org/sqlite"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,11 +41,19 @@ type location struct {
 	lon         float32
 	ianaName    string
 	displayName string
+	// deliveryHour and deliveryMinute is the local time at which the summary is pushed
+	deliveryHour   uint
+	deliveryMinute uint
+	// units and language override the units and language of the prompt. empty means the default of the prompt set.
+	units    string
+	language string
 }
 
 // pageTemplate stores all pre-compiled HTML templates for the application
 type pageTemplate struct {
-	summary *template.Template
+	index          *template.Template
+	summary        *template.Template
+	adminDashboard *template.Template
 }
 
 // summaryTemplateData stores template data for summary.html
@@ -46,25 +61,59 @@ type summaryTemplateData struct {
 	Summary      string
 	Location     string
 	LocationName string
+	// DeliveryTime is the local time at which the summary of the location is pushed, e.g. "07:00"
+	DeliveryTime string
 }
 
 // updateSubscription is the request body for creating/updating registration
 type updateSubscription struct {
-	Subscription    webpush.Subscription `json:"subscription"`
-	Locations       []string             `json:"locations"`
-	RemoveLocations []string             `json:"removeLocations"`
+	// Channel is the delivery channel of the registration. It can be omitted when updating a registration.
+	Channel string `json:"channel,omitempty"`
+	// Config is the channel config of the registration, e.g. the webhook URL
+	Config json.RawMessage `json:"config,omitempty"`
+	// Subscription is the config of the webpush channel, and is accepted in place of Config
+	Subscription    *webpush.Subscription `json:"subscription,omitempty"`
+	Locations       []string              `json:"locations"`
+	RemoveLocations []string              `json:"removeLocations"`
+	// Coordinates subscribes the registration to the location nearest to them, which replaces the previous "my location"
+	Coordinates *coordinates `json:"coordinates,omitempty"`
+
+	// config is the validated channel config, or nil if the request does not change it
+	config json.RawMessage
+	// myLocation is the location that Coordinates snapped to
+	myLocation string
+	// createdMyLocation is true if myLocation was created for the request
+	createdMyLocation bool
 }
 
-// registeredSubscription represents a registered webpush subscription.
+// registeredSubscription represents a registration of a delivery channel, such as a web push subscription.
 type registeredSubscription struct {
-	ID           uuid.UUID             `json:"id"`
-	Subscription *webpush.Subscription `json:"-"`
-	Locations    []string              `json:"locations"`
+	ID      uuid.UUID `json:"id"`
+	Channel string    `json:"channel"`
+	// Config is the channel config, which contains secrets such as push keys and is never sent to clients
+	Config    json.RawMessage `json:"-"`
+	Locations []string        `json:"locations"`
+	// Coordinates are the last coordinates sent with the registration, if any
+	Coordinates *coordinates `json:"coordinates,omitempty"`
+	// MyLocation is the location that Coordinates snapped to
+	MyLocation string `json:"myLocation,omitempty"`
 }
 
 type webpushNotificationPayload struct {
 	Summary  string `json:"summary"`
 	Location string `json:"location"`
+	Advisory string `json:"advisory,omitempty"`
+}
+
+// summaryUpdate is sent to the push listener of a location when a new summary is generated
+type summaryUpdate struct {
+	summary string
+	// advisory is an optional warning, such as poor air quality, that is pushed along with the summary
+	advisory string
+	// forecast is the forecast of the day that the summary is based on, or nil if it is not known
+	forecast *forecastStats
+	// spanContext is the span of the update that produced the summary, which push spans are children of
+	spanContext trace.SpanContext
 }
 
 type metAPIData struct {
@@ -79,20 +128,62 @@ type updateSummaryOptions struct {
 	pushUpdate bool
 }
 
+// locationStatus tracks the outcome of the most recent summary updates and pushes of a location
+type locationStatus struct {
+	lastUpdated time.Time
+	lastError   error
+	lastErrorAt time.Time
+	// lastLatency is how long it took to generate the latest summary
+	lastLatency time.Duration
+	// lastAdvisory is the advisory that was generated along with the latest summary
+	lastAdvisory string
+	// lastForecast is the forecast of the day that the latest summary is based on
+	lastForecast *forecastStats
+
+	// listenerRunning is whether the push listener goroutine of the location is running
+	listenerRunning bool
+	lastPushAt      time.Time
+	// pushesSucceeded and pushesFailed count deliveries of summaries since the server started
+	pushesSucceeded int
+	pushesFailed    int
+}
+
 type state struct {
 	ctx             context.Context
 	metAPIUserAgent string
 	genai           *genai.Client
 	template        pageTemplate
+	prompts         *promptSet
 
 	db      *sql.DB
 	dbMutex sync.Mutex
 
 	// summaries maps location keys to their latest weather summary
 	summaries sync.Map
-	// summaryChans stores a map of location key to the corresponding summary channel
-	// which is used to track summary updates
-	summaryChans map[string]chan string
+
+	// locationStatuses maps location keys to the status of their summary updates
+	locationStatuses map[string]*locationStatus
+	// locationStatusesMutex syncs access to locationStatuses
+	locationStatusesMutex sync.Mutex
+
+	// locationsFile is the path of the locations file, or empty if the built-in locations are used
+	locationsFile string
+	// locationJobs maps location keys to the scheduled job and push listener of the location
+	locationJobs map[string]*locationJob
+	// locationJobsMutex syncs access to locationJobs
+	locationJobsMutex sync.Mutex
+	// gazetteer is searched for places that can be added as locations
+	gazetteer *gazetteer
+	// maxDynamicLocations is the maximum number of locations that can be added from the gazetteer
+	maxDynamicLocations int
+	// dynamicLocationRetention is how long a location added from the gazetteer is kept without subscribers.
+	// 0 keeps them forever.
+	dynamicLocationRetention time.Duration
+	// dynamicLocationsMutex serializes the creation and removal of dynamic locations, and reloads of the locations file
+	dynamicLocationsMutex sync.Mutex
+
+	// schedulersRunning is set once the schedulers of all locations are started
+	schedulersRunning atomic.Bool
 
 	// subscriptions maps location keys to the list of registered subscriptions
 	// that are subscribed to updates for the location
@@ -100,11 +191,29 @@ type state struct {
 	// subscriptionsMutex syncs writes to subscriptions
 	subscriptionsMutex sync.Mutex
 
+	// notifiers maps the enabled delivery channels to their notifier
+	notifiers map[string]Notifier
+	// mailer sends summaries by email. nil if email delivery is disabled.
+	mailer *mailer
+	// publicURL is the public url of 7am, which links in deliveries point to. empty if PUBLIC_URL is not set.
+	publicURL string
+
+	// airQuality provides air quality data for the summarizer. nil if air quality data is disabled.
+	airQuality airQualityProvider
+	// airQualityThreshold is the level at which an air quality advisory is added to the push
+	airQualityThreshold airQualityLevel
+
 	vapidSubject string
 	// vapidPublicKey is the base64 url encoded VAPID public key
 	vapidPublicKey string
 	// vapidPrivateKey is the base64 url encoded VAPID private key
 	vapidPrivateKey string
+
+	// trustedProxies are the addresses of reverse proxies whose X-Forwarded-For header is trusted
+	trustedProxies []netip.Prefix
+
+	// adminToken is the bearer token required by the admin api. the admin api is disabled if it is empty.
+	adminToken string
 }
 
 //go:embed web
@@ -115,35 +224,29 @@ var envKeys = []string{"GEMINI_API_KEY", "MET_API_USER_AGENT", "VAPID_SUBJECT",
 //go:embed prompt.txt
 var prompt string
 
-var supportedLocations = map[string]*location{
-	"london":    {nil, 51.507351, -0.127758, "Europe/London", "London"},
-	"sf":        {nil, 37.774929, -122.419418, "America/Los_Angeles", "San Francisco"},
-	"sj":        {nil, 37.338207, -121.886330, "America/Los_Angeles", "San Jose"},
-	"la":        {nil, 34.052235, -118.243683, "America/Los_Angeles", "Los Angeles"},
-	"nyc":       {nil, 40.712776, -74.005974, "America/New_York", "New York City"},
-	"tokyo":     {nil, 35.689487, 139.691711, "Asia/Tokyo", "Tokyo"},
-	"singapore": {nil, 1.290270, 103.851959, "Asia/Singapore", "Singapore"},
-	"manila":    {nil, 14.599512, 120.984222, "Asia/Manila", "Manila"},
-	"hk":        {nil, 22.317053, 114.169547, "Asia/Hong_Kong", "Hong Kong"},
-	"warsaw":    {nil, 52.229675, 21.012230, "Europe/Warsaw", "Warsaw"},
-	"zurich":    {nil, 47.369019, 8.538030, "Europe/Zurich", "Zurich"},
-	"berlin":    {nil, 52.520008, 13.404954, "Europe/Berlin", "Berlin"},
-	"dubai":     {nil, 25.204849, 55.270782, "Asia/Dubai", "Dubai"},
-	"paris":     {nil, 48.864716, 2.349014, "Europe/Paris", "Paris"},
-	"stockholm": {nil, 59.329323, 18.068581, "Europe/Stockholm", "Stockholm"},
-	"amsterdam": {nil, 52.370216, 4.895168, "Europe/Amsterdam", "Amsterdam"},
-	"newdelhi":  {nil, 28.613939, 77.209023, "Asia/Kolkata", "New Delhi"},
-	"mumbai":    {nil, 19.075983, 72.877655, "Asia/Kolkata", "Mumbai"},
-}
-
 func main() {
 	port := flag.Int("port", 8080, "the port that the server should listen on")
 	genKeys := flag.Bool("generate-vapid-keys", false, "generate a new vapid key pair, which will be outputted to stdout.")
+	evalDir := flag.String("eval", "", "generate summaries for the recorded forecast fixtures in the given directory, and print an evaluation report to stdout.")
+	testEmail := flag.String("send-test-email", "", "send a summary email with sample content to the given address using the SMTP_* configuration.")
+	recordDir := flag.String("record-fixtures", "", "record the current forecast of every location as eval fixtures in the given directory.")
 
 	flag.Parse()
 
 	if *genKeys {
 		generateKeys()
+	} else if *testEmail != "" {
+		if err := sendTestEmail(*testEmail); err != nil {
+			log.Fatal(err)
+		}
+	} else if *recordDir != "" {
+		if err := recordFixtures(*recordDir); err != nil {
+			log.Fatal(err)
+		}
+	} else if *evalDir != "" {
+		if err := runEval(*evalDir); err != nil {
+			log.Fatal(err)
+		}
 	} else if err := startServer(*port); err != nil {
 		log.Fatal(err)
 	}
@@ -152,13 +255,14 @@ func main() {
 func startServer(port int) error {
 	slog.Info("starting 7am...")
 
-	err := loadTimeZones()
+	_ = godotenv.Load()
+	err := checkEnv()
 	if err != nil {
 		return err
 	}
 
-	_ = godotenv.Load()
-	err = checkEnv()
+	locationsFile := os.Getenv("LOCATIONS_FILE")
+	err = initLocations(locationsFile)
 	if err != nil {
 		return err
 	}
@@ -175,101 +279,195 @@ func startServer(port int) error {
 	}
 	slog.Info("data directory created", "path", p)
 
-	db, err := initDB()
+	db, err := initDB("file:data/data.sqlite")
 	if err != nil {
 		return fmt.Errorf("failed to initialize db: %w", err)
 	}
 
+	err = loadDynamicLocations(db)
+	if err != nil {
+		return fmt.Errorf("failed to load dynamic locations: %w", err)
+	}
+
+	gazetteer, err := loadGazetteer()
+	if err != nil {
+		return fmt.Errorf("failed to load gazetteer: %w", err)
+	}
+	slog.Info("gazetteer loaded", "places", len(gazetteer.places))
+
+	maxDynamicLocations, err := parseMaxDynamicLocations(os.Getenv("MAX_DYNAMIC_LOCATIONS"))
+	if err != nil {
+		return err
+	}
+
+	dynamicLocationRetention, err := parseDynamicLocationRetention(os.Getenv("DYNAMIC_LOCATION_RETENTION_DAYS"))
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdownTracing, err := setupTracing(ctx, os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	genaiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  os.Getenv("GEMINI_API_KEY"),
-		Backend: genai.BackendGeminiAPI,
+		APIKey:     os.Getenv("GEMINI_API_KEY"),
+		Backend:    genai.BackendGeminiAPI,
+		HTTPClient: httpClient,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to initialize gemini client: %w\n", err)
 	}
 
+	prompts, err := loadPrompts(os.Getenv("PROMPT_DIR"))
+	if err != nil {
+		return err
+	}
+
+	airQuality, err := newAirQualityProvider(os.Getenv("AIR_QUALITY_PROVIDER"), os.Getenv("MET_API_USER_AGENT"))
+	if err != nil {
+		return err
+	}
+
+	airQualityThreshold, err := parseAirQualityLevel(os.Getenv("AIR_QUALITY_ADVISORY_LEVEL"))
+	if err != nil {
+		return err
+	}
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+
+	mailer, err := newMailerFromEnv()
+	if err != nil {
+		return err
+	}
+
+	allowPrivateWebhooks := false
+	if v := os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS"); v != "" {
+		allowPrivateWebhooks, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid WEBHOOK_ALLOW_PRIVATE_NETWORKS: %w", err)
+		}
+	}
+
+	indexHTML, _ := webDir.ReadFile("web/index.html")
+	indexPageTemplate, _ := template.New("index.html").Parse(string(indexHTML))
+
 	summaryHTML, _ := webDir.ReadFile("web/summary.html")
 	summaryPageTemplate, _ := template.New("summary.html").Parse(string(summaryHTML))
 
+	adminDashboardHTML, _ := adminDir.ReadFile("admin/dashboard.html")
+	adminDashboardTemplate, _ := template.New("dashboard.html").Parse(string(adminDashboardHTML))
+
 	state := state{
 		ctx:             ctx,
 		metAPIUserAgent: os.Getenv("MET_API_USER_AGENT"),
 		template: pageTemplate{
-			summary: summaryPageTemplate,
+			index:          indexPageTemplate,
+			summary:        summaryPageTemplate,
+			adminDashboard: adminDashboardTemplate,
 		},
-		summaries:    sync.Map{},
-		summaryChans: map[string]chan string{},
-		genai:        genaiClient,
+		prompts:   prompts,
+		summaries: sync.Map{},
+		genai:     genaiClient,
+
+		locationStatuses: map[string]*locationStatus{},
+		locationsFile:    locationsFile,
+		locationJobs:     map[string]*locationJob{},
+
+		gazetteer:                gazetteer,
+		maxDynamicLocations:      maxDynamicLocations,
+		dynamicLocationRetention: dynamicLocationRetention,
+
+		airQuality:          airQuality,
+		airQualityThreshold: airQualityThreshold,
 
 		db:      db,
 		dbMutex: sync.Mutex{},
 
 		subscriptions: map[string][]*registeredSubscription{},
 
+		mailer:    mailer,
+		publicURL: strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"),
+
 		vapidSubject:    os.Getenv("VAPID_SUBJECT"),
 		vapidPublicKey:  os.Getenv("VAPID_PUBLIC_KEY_BASE64"),
 		vapidPrivateKey: os.Getenv("VAPID_PRIVATE_KEY_BASE64"),
+
+		trustedProxies: trustedProxies,
+		adminToken:     os.Getenv("ADMIN_TOKEN"),
 	}
 
-	fetchInitialSummaries(&state)
+	state.notifiers = map[string]Notifier{
+		channelWebPush: &webpushNotifier{state: &state},
+		channelWebhook: newWebhookNotifier(state.publicURL, allowPrivateWebhooks),
+		channelNtfy: &ntfyNotifier{
+			client:               newOutboundClient(allowPrivateWebhooks),
+			publicURL:            state.publicURL,
+			allowPrivateNetworks: allowPrivateWebhooks,
+		},
+		channelGotify: &gotifyNotifier{
+			client:               newOutboundClient(allowPrivateWebhooks),
+			publicURL:            state.publicURL,
+			allowPrivateNetworks: allowPrivateWebhooks,
+		},
+	}
+	if mailer != nil {
+		state.notifiers[channelEmail] = mailer
+	}
+
+	telegramBot, err := newTelegramBotFromEnv(&state)
+	if err != nil {
+		return err
+	}
+	if telegramBot != nil {
+		state.notifiers[channelTelegram] = telegramBot
+	}
 
-	var schedulers []gocron.Scheduler
+	prometheus.MustRegister(newStateCollector(&state))
+
+	fetchInitialSummaries(&state)
 
 	// schedule periodic updates of weather summary for each supported location
-	for locKey, loc := range supportedLocations {
-		s, err := gocron.NewScheduler(gocron.WithLocation(loc.tz))
-		if err != nil {
-			return fmt.Errorf("failed to create gocron scheduler for %v: %w", locKey, err)
-		}
-
-		_, err = s.NewJob(
-			gocron.DailyJob(1, gocron.NewAtTimes(gocron.NewAtTime(7, 0, 0))),
-			gocron.NewTask(func(ctx context.Context) {
-				updateSummary(ctx, &state, updateSummaryOptions{
-					locKey:     locKey,
-					location:   loc,
-					pushUpdate: true,
-				})
-			}),
-		)
+	for locKey, loc := range supportedLocations() {
+		err := startLocation(&state, locKey, loc)
 		if err != nil {
-			return fmt.Errorf("failed to scheduel gocron job for %v: %w", locKey, err)
+			return err
 		}
+	}
 
-		schedulers = append(schedulers, s)
-		c := make(chan string)
-
-		state.subscriptions[locKey] = []*registeredSubscription{}
-		state.summaryChans[locKey] = c
+	state.schedulersRunning.Store(true)
 
-		// listen for summary updates, and publish updates to all update subscribers via web push
-		go listenForSummaryUpdates(&state, locKey, c)
+	err = loadSubscriptions(&state, supportedLocationKeys())
+	if err != nil {
+		return fmt.Errorf("failed to load existing subscriptions: %w", err)
+	}
 
-		s.Start()
+	go watchLocationsFile(&state)
 
-		slog.Info("update job scheduled", "location", locKey)
+	if state.dynamicLocationRetention > 0 {
+		go pruneDynamicLocationsPeriodically(&state)
 	}
 
-	err = loadSubscriptions(&state)
-	if err != nil {
-		return fmt.Errorf("failed to load existing subscriptions: %w", err)
+	if telegramBot != nil {
+		go telegramBot.poll(ctx)
 	}
 
-	http.HandleFunc("/", handleHTTPRequest(&state))
-
 	slog.Info("server starting", "port", port)
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	err = http.ListenAndServe(fmt.Sprintf(":%d", port), newRouter(&state))
 	if err != nil {
 		return fmt.Errorf("failed to start http server: %w", err)
 	}
 
-	for _, s := range schedulers {
-		s.Shutdown()
-	}
+	state.schedulersRunning.Store(false)
+	stopAllLocations(&state)
 
 	slog.Info("7am shut down")
 
@@ -301,165 +499,250 @@ func checkEnv() error {
 	return nil
 }
 
-func handleHTTPRequest(state *state) http.HandlerFunc {
+func handleInstructions(writer http.ResponseWriter, request *http.Request) {
+	f, _ := webDir.ReadFile("web/instructions.html")
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Write(f)
+}
+
+func handleVAPIDPublicKey(state *state) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		path := strings.TrimPrefix(request.URL.Path, "/")
+		writer.Write([]byte(state.vapidPublicKey))
+	}
+}
 
-		if path == "" {
-			if request.Method == "" || request.Method == "GET" {
-				index, _ := webDir.ReadFile("web/index.html")
-				writer.Write(index)
-			} else {
-				writer.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		} else if path == "instructions" {
-			f, _ := webDir.ReadFile("web/instructions.html")
-			writer.Write(f)
-		} else if path == "vapid" {
-			if request.Method == "" || request.Method == "GET" {
-				writer.Write([]byte(state.vapidPublicKey))
-			} else {
-				writer.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		} else if strings.HasPrefix(path, "registrations") {
-			if path == "registrations" && request.Method == "POST" {
-				defer request.Body.Close()
-
-				update := updateSubscription{}
-				err := json.NewDecoder(request.Body).Decode(&update)
-				if err != nil {
-					writer.WriteHeader(http.StatusBadRequest)
-					return
-				}
+func handleCreateRegistration(state *state, locationLimiter *rateLimiter) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
 
-				reg, err := registerSubscription(state, &update)
-				if err != nil {
-					slog.Error("web push subscription registration failed", "error", err)
-					writer.WriteHeader(http.StatusBadRequest)
-					return
-				}
+		defer request.Body.Close()
 
-				err = json.NewEncoder(writer).Encode(reg)
-				if err != nil {
-					writer.WriteHeader(http.StatusBadRequest)
-				} else {
-					slog.Info("new web push registration", "id", reg.ID)
-				}
-			} else if request.Method == "PATCH" || request.Method == "DELETE" {
-				parts := strings.Split(path, "/")
-				if len(parts) < 2 {
-					writer.WriteHeader(http.StatusMethodNotAllowed)
-					return
-				}
+		update := updateSubscription{}
+		err := json.NewDecoder(request.Body).Decode(&update)
+		if err != nil {
+			logger.Warn("invalid registration request body", "error", err)
+			writeRequestBodyError(writer, err)
+			return
+		}
 
-				regID, err := uuid.Parse(parts[1])
-				if err != nil {
-					writer.WriteHeader(http.StatusNotFound)
-					return
-				}
+		err = validateUpdateSubscription(state, &update)
+		if err != nil {
+			logger.Warn("invalid registration", "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
+		if update.config == nil {
+			writeRegistrationError(writer, fmt.Errorf("%w: a channel config or web push subscription is required", errInvalidSubscription))
+			return
+		}
 
-				switch request.Method {
-				case "PATCH":
-					defer request.Body.Close()
-
-					update := updateSubscription{}
-					err = json.NewDecoder(request.Body).Decode(&update)
-					if err != nil {
-						writer.WriteHeader(http.StatusBadRequest)
-						return
-					}
-
-					reg, err := updateRegisteredSubscription(state, regID, &update)
-					if err != nil {
-						if errors.Is(err, sql.ErrNoRows) {
-							writer.WriteHeader(http.StatusNotFound)
-						} else {
-							writer.WriteHeader(http.StatusInternalServerError)
-						}
-					} else {
-						json.NewEncoder(writer).Encode(reg)
-						slog.Info("web push registration updated", "id", reg.ID, "locations", strings.Join(reg.Locations, ","))
-					}
-
-				case "DELETE":
-					err = deleteSubscription(state, regID)
-					if err != nil {
-						if errors.Is(err, sql.ErrNoRows) {
-							writer.WriteHeader(http.StatusNotFound)
-						} else {
-							writer.WriteHeader(http.StatusInternalServerError)
-						}
-					} else {
-						writer.WriteHeader(http.StatusNoContent)
-						slog.Info("web push registration deleted", "id", regID)
-					}
-				}
+		limited, err := resolveMyLocation(state, &update, locationLimiter, writer, request)
+		if limited {
+			return
+		}
+		if err != nil {
+			logger.Error("registration failed", "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
 
-			} else {
-				writer.WriteHeader(http.StatusMethodNotAllowed)
+		token, tokenHash, err := newRegistrationToken()
+		if err != nil {
+			logger.Error("registration failed", "error", err)
+			discardMyLocation(state, &update)
+			writeInternalError(writer)
+			return
+		}
+
+		reg, err := registerSubscription(state, &update, tokenHash)
+		if err != nil {
+			logger.Error("registration failed", "error", err)
+			discardMyLocation(state, &update)
+			writeRegistrationError(writer, err)
+			return
+		}
+
+		registrationsCreatedTotal.Inc()
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(registrationResponse{reg, token})
+		logger.Info("new registration", "id", reg.ID, "channel", reg.Channel)
+	}
+}
+
+func handleUpdateRegistration(state *state, locationLimiter *rateLimiter) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
+
+		defer request.Body.Close()
+
+		regID, err := uuid.Parse(request.PathValue("id"))
+		if err != nil {
+			writeRegistrationError(writer, sql.ErrNoRows)
+			return
+		}
+
+		update := updateSubscription{}
+		err = json.NewDecoder(request.Body).Decode(&update)
+		if err != nil {
+			logger.Warn("invalid registration request body", "id", regID, "error", err)
+			writeRequestBodyError(writer, err)
+			return
+		}
+
+		err = validateUpdateSubscription(state, &update)
+		if err != nil {
+			logger.Warn("invalid registration", "id", regID, "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
+
+		legacy, err := authorizeRegistration(state, regID, request, update.Subscription)
+		if err != nil {
+			logger.Warn("registration update rejected", "id", regID, "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
+
+		limited, err := resolveMyLocation(state, &update, locationLimiter, writer, request)
+		if limited {
+			return
+		}
+		if err != nil {
+			logger.Error("registration update failed", "id", regID, "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
+
+		// a registration without a token is claimed by issuing a token along with the update
+		var token, tokenHash string
+		if legacy {
+			token, tokenHash, err = newRegistrationToken()
+			if err != nil {
+				logger.Error("registration update failed", "id", regID, "error", err)
+				discardMyLocation(state, &update)
+				writeInternalError(writer)
+				return
 			}
+		}
 
-		} else if strings.HasPrefix(path, "api/") {
-			if origin := request.Header.Get("Origin"); origin != "" {
-				writer.Header().Set("Access-Control-Allow-Origin", origin)
+		reg, err := updateRegisteredSubscription(state, regID, &update, tokenHash)
+		if err != nil {
+			discardMyLocation(state, &update)
+			if !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, errInvalidSubscription) && !errors.Is(err, errInvalidRegistrationToken) {
+				logger.Error("registration update failed", "id", regID, "error", err)
 			}
+			writeRegistrationError(writer, err)
+		} else {
+			writer.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(writer).Encode(registrationResponse{reg, token})
+			logger.Info("registration updated", "id", reg.ID, "locations", strings.Join(reg.Locations, ","), "claimed", legacy)
+		}
+	}
+}
 
-			if strings.HasPrefix(path, "api/summary/") {
-				switch request.Method {
-				case "OPTIONS":
-					writer.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-					writer.WriteHeader(http.StatusOK)
+func handleDeleteRegistration(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
 
-				case "GET":
-					location := strings.TrimPrefix(path, "api/summary/")
-					summary, ok := state.summaries.Load(location)
-					if !ok {
-						writer.WriteHeader(http.StatusNotFound)
-						return
-					}
+		regID, err := uuid.Parse(request.PathValue("id"))
+		if err != nil {
+			writeRegistrationError(writer, sql.ErrNoRows)
+			return
+		}
 
-					response := map[string]string{
-						"summary": strings.TrimSpace(summary.(string)),
-					}
+		defer request.Body.Close()
 
-					writer.Header().Set("Content-Type", "application/json")
+		body := deleteRegistrationRequest{}
+		err = json.NewDecoder(request.Body).Decode(&body)
+		if err != nil && !errors.Is(err, io.EOF) {
+			logger.Warn("invalid registration request body", "id", regID, "error", err)
+			writeRequestBodyError(writer, err)
+			return
+		}
 
-					json.NewEncoder(writer).Encode(response)
+		_, err = authorizeRegistration(state, regID, request, body.Subscription)
+		if err != nil {
+			logger.Warn("registration deletion rejected", "id", regID, "error", err)
+			writeRegistrationError(writer, err)
+			return
+		}
 
-				default:
-					writer.WriteHeader(http.StatusMethodNotAllowed)
-				}
-			} else {
-				writer.WriteHeader(http.StatusNotFound)
+		err = deleteSubscription(state, regID)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				logger.Error("registration deletion failed", "id", regID, "error", err)
 			}
+			writeRegistrationError(writer, err)
+		} else {
+			registrationsDeletedTotal.Inc()
+			writer.WriteHeader(http.StatusNoContent)
+			logger.Info("registration deleted", "id", regID)
+		}
+	}
+}
+
+func handleSummaryAPI(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		locKey := request.PathValue("loc")
+		if _, ok := lookupLocation(locKey); !ok {
+			writeError(writer, http.StatusNotFound, errCodeUnknownLocation, fmt.Sprintf("unknown location %v", locKey), unknownLocationsDetails{
+				UnknownLocations: []string{locKey},
+				ValidLocations:   supportedLocationKeys(),
+			})
+			return
+		}
+
+		summary, ok := state.summaries.Load(locKey)
+		if !ok {
+			writeError(writer, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("the summary of %v is not available yet", locKey), nil)
+			return
+		}
+
+		response := map[string]string{
+			"summary": strings.TrimSpace(summary.(string)),
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+
+		json.NewEncoder(writer).Encode(response)
+	}
+}
+
+// handlePage serves the summary page of a location, or a static file from web/ if path is not a location.
+func handlePage(state *state) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		path := request.PathValue("path")
+
+		summary, hasSummary := state.summaries.Load(path)
+		loc, ok := lookupLocation(path)
+		if ok && hasSummary {
+			writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			state.template.summary.Execute(writer, summaryTemplateData{summary.(string), path, loc.displayName, loc.deliveryTime()})
 		} else {
-			if request.Method != "" && request.Method != "GET" {
-				writer.WriteHeader(http.StatusMethodNotAllowed)
+			// templates are only served rendered
+			if path == "index.html" || path == "summary.html" {
+				writeError(writer, http.StatusNotFound, errCodeNotFound, "not found", nil)
 				return
 			}
 
-			summary, ok := state.summaries.Load(path)
-			if ok {
-				loc := supportedLocations[path]
-				state.template.summary.Execute(writer, summaryTemplateData{summary.(string), path, loc.displayName})
+			f, err := webDir.ReadFile("web/" + path)
+			if err != nil {
+				writeError(writer, http.StatusNotFound, errCodeNotFound, "not found", nil)
 			} else {
-				f, err := webDir.ReadFile("web/" + path)
-				if err != nil {
-					writer.WriteHeader(http.StatusNotFound)
-				} else {
-					m := mime.TypeByExtension(filepath.Ext(path))
-					if m != "" {
-						writer.Header().Set("Content-Type", m)
-					}
-					writer.Write(f)
+				m := mime.TypeByExtension(filepath.Ext(path))
+				if m != "" {
+					writer.Header().Set("Content-Type", m)
 				}
+				writer.Write(f)
 			}
 		}
 	}
 }
 
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite", "file:data/data.sqlite")
+// initDB opens the sqlite database at dsn, and creates or migrates its tables.
+func initDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		log.Fatalln("failed to initialize database")
 	}
@@ -478,16 +761,72 @@ func initDB() (*sql.DB, error) {
 			location TEXT PRIMARY KEY,
 			summary TEXT NOT NULL
 		);
+
+		-- email subscriptions waiting for confirmation. once confirmed, they are registrations of the email channel,
+		-- and confirmed_at is only kept so that opening the confirmation link again does not fail.
+		CREATE TABLE IF NOT EXISTS email_subscriptions(
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			locations TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			confirmed_at INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS dynamic_locations(
+			key TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			lat REAL NOT NULL,
+			lon REAL NOT NULL,
+			timezone TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);
 	`)
 	if err != nil {
 		return nil, err
 	}
 
+	// updated_at is a unix timestamp that was added after the summaries table was introduced,
+	// so existing databases have to be migrated. cached summaries without it have an updated_at of 0.
+	_, err = db.Exec("ALTER TABLE summaries ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return nil, err
+	}
+
+	// token_hash is the sha256 hash of the management token of a registration.
+	// registrations created before it was introduced have no token until they are claimed by their next update.
+	_, err = db.Exec("ALTER TABLE subscriptions ADD COLUMN token_hash TEXT")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return nil, err
+	}
+
+	// lat, lon, and my_location are the coordinates sent with a registration for "my location",
+	// and the location that they snapped to
+	for _, column := range []string{"lat REAL", "lon REAL", "my_location TEXT"} {
+		_, err = db.Exec("ALTER TABLE subscriptions ADD COLUMN " + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, err
+		}
+	}
+
+	// unused_since is when a dynamic location was first seen without subscribers, or null if it has subscribers
+	_, err = db.Exec("ALTER TABLE dynamic_locations ADD COLUMN unused_since INTEGER")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return nil, err
+	}
+
+	// channel is the delivery channel of a registration, and subscription_json is its channel config.
+	// registrations created before channels were introduced are web push subscriptions.
+	_, err = db.Exec("ALTER TABLE subscriptions ADD COLUMN channel TEXT NOT NULL DEFAULT 'webpush'")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return nil, err
+	}
+
 	return db, nil
 }
 
-func loadSubscriptions(state *state) error {
-	rows, err := state.db.Query(`SELECT id, locations, subscription_json FROM subscriptions;`)
+// loadSubscriptions loads the registrations in the database, and adds them to the subscribers of the given locations.
+func loadSubscriptions(state *state, locKeys []string) error {
+	rows, err := state.db.Query(`SELECT id, channel, locations, subscription_json FROM subscriptions;`)
 	if err != nil {
 		return err
 	}
@@ -495,57 +834,99 @@ func loadSubscriptions(state *state) error {
 
 	for rows.Next() {
 		var id string
+		var channel string
 		var locations string
 		var j string
 
-		err := rows.Scan(&id, &locations, &j)
+		err := rows.Scan(&id, &channel, &locations, &j)
 		if err != nil {
 			slog.Warn("unable to load a subscription", "error", err)
 			continue
 		}
 
-		s := webpush.Subscription{}
-		err = json.Unmarshal([]byte(j), &s)
-		if err != nil {
-			slog.Warn("invalid web push subscription json encountered", "id", id, "error", err)
+		if !json.Valid([]byte(j)) {
+			slog.Warn("invalid channel config json encountered", "id", id, "channel", channel)
 			continue
 		}
 
 		reg := &registeredSubscription{
-			ID:           uuid.MustParse(id),
-			Locations:    strings.Split(locations, ","),
-			Subscription: &s,
+			ID:        uuid.MustParse(id),
+			Channel:   channel,
+			Config:    json.RawMessage(j),
+			Locations: strings.Split(locations, ","),
 		}
 
+		// locations that have been removed since the registration was made are kept in the database,
+		// so that the registration resumes if the location is added back, but nothing is pushed for them.
+		var stale []string
+		state.subscriptionsMutex.Lock()
 		for _, l := range reg.Locations {
-			state.subscriptions[l] = append(state.subscriptions[l], reg)
+			if slices.Contains(locKeys, l) {
+				state.subscriptions[l] = append(state.subscriptions[l], reg)
+			} else if _, ok := lookupLocation(l); !ok {
+				stale = append(stale, l)
+			}
+		}
+		state.subscriptionsMutex.Unlock()
+		if len(stale) > 0 {
+			slog.Warn("registration subscribes to unsupported locations", "id", id, "locations", strings.Join(stale, ","))
 		}
 	}
 
 	return nil
 }
 
-func updateRegisteredSubscription(state *state, id uuid.UUID, update *updateSubscription) (*registeredSubscription, error) {
-	j, err := json.Marshal(update.Subscription)
+// updateRegisteredSubscription applies update to the registration with the given id.
+// If tokenHash is not empty, the registration is claimed with it, which fails with errInvalidRegistrationToken
+// if the registration already has a token.
+func updateRegisteredSubscription(state *state, id uuid.UUID, update *updateSubscription, tokenHash string) (*registeredSubscription, error) {
+	err := checkLocations(update.Locations)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := state.db.Query("SELECT locations FROM subscriptions WHERE id = ?", id)
+	rows, err := state.db.Query("SELECT channel, subscription_json, locations, lat, lon, my_location FROM subscriptions WHERE id = ?", id)
 	if err != nil {
 		return nil, err
 	}
 
 	rows.Next()
 
+	var channel string
+	var config []byte
 	var locStr string
-	err = rows.Scan(&locStr)
+	var lat, lon sql.NullFloat64
+	var myLocation sql.NullString
+	err = rows.Scan(&channel, &config, &locStr, &lat, &lon, &myLocation)
 	if err != nil {
 		return nil, err
 	}
 
 	rows.Close()
 
+	if update.Channel != "" && update.Channel != channel {
+		return nil, fmt.Errorf("%w: the channel of a registration cannot be changed", errInvalidSubscription)
+	}
+	if update.config != nil {
+		config = update.config
+	}
+
+	coords := update.Coordinates
+	if coords == nil && lat.Valid && lon.Valid {
+		coords = &coordinates{float32(lat.Float64), float32(lon.Float64)}
+	}
+	if update.myLocation != "" {
+		// the previous "my location" is replaced, unless it is also subscribed to explicitly
+		if myLocation.Valid && myLocation.String != update.myLocation && !slices.Contains(update.Locations, myLocation.String) {
+			update.RemoveLocations = append(update.RemoveLocations, myLocation.String)
+		}
+		myLocation = sql.NullString{String: update.myLocation, Valid: true}
+	}
+	if coords != nil {
+		lat = sql.NullFloat64{Float64: float64(coords.Lat), Valid: true}
+		lon = sql.NullFloat64{Float64: float64(coords.Lon), Valid: true}
+	}
+
 	// not very proud of this one
 	// ideally the list of locations should be stored in a separate table
 	// but since the list is very small, and im too lazy to bring in a separate table
@@ -557,38 +938,67 @@ func updateRegisteredSubscription(state *state, id uuid.UUID, update *updateSubs
 	})
 	locs = slices.Compact(locs)
 
-	_, err = state.db.Exec(
-		"UPDATE subscriptions SET subscription_json = ?, locations = ? WHERE id = ?",
-		string(j), strings.Join(locs, ","), id,
-	)
+	query := "UPDATE subscriptions SET subscription_json = ?, locations = ?, lat = ?, lon = ?, my_location = ? WHERE id = ?"
+	args := []any{string(config), strings.Join(locs, ","), lat, lon, myLocation, id}
+	if tokenHash != "" {
+		// the token is only set if the registration has none yet, so that two concurrent claims can not both succeed
+		query = "UPDATE subscriptions SET subscription_json = ?, locations = ?, lat = ?, lon = ?, my_location = ?, token_hash = ? WHERE id = ? AND token_hash IS NULL"
+		args = []any{string(config), strings.Join(locs, ","), lat, lon, myLocation, tokenHash, id}
+	}
+
+	res, err := state.db.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
 		return nil, err
 	}
+	if n == 0 {
+		if tokenHash != "" {
+			return nil, errInvalidRegistrationToken
+		}
+		return nil, sql.ErrNoRows
+	}
 
 	reg := &registeredSubscription{
-		ID:           id,
-		Subscription: &update.Subscription,
-		Locations:    locs,
+		ID:          id,
+		Channel:     channel,
+		Config:      config,
+		Locations:   locs,
+		Coordinates: coords,
+		MyLocation:  myLocation.String,
 	}
 
+	indexRegistration(state, reg)
+
+	return reg, nil
+}
+
+// indexRegistration replaces the previous version of reg in the subscribers of every location,
+// and adds reg to the subscribers of the supported locations it is subscribed to.
+func indexRegistration(state *state, reg *registeredSubscription) {
 	state.subscriptionsMutex.Lock()
-	for _, l := range update.Locations {
-		state.subscriptions[l] = append(state.subscriptions[l], reg)
+	defer state.subscriptionsMutex.Unlock()
+
+	isReg := func(s *registeredSubscription) bool {
+		return s.ID == reg.ID
 	}
-	for _, l := range update.RemoveLocations {
-		state.subscriptions[l] = slices.DeleteFunc(state.subscriptions[l], func(s *registeredSubscription) bool {
-			return s.ID == reg.ID
-		})
+	for l, subs := range state.subscriptions {
+		state.subscriptions[l] = slices.DeleteFunc(subs, isReg)
+	}
+	for _, l := range reg.Locations {
+		if _, ok := lookupLocation(l); ok && !slices.ContainsFunc(state.subscriptions[l], isReg) {
+			state.subscriptions[l] = append(state.subscriptions[l], reg)
+		}
 	}
-	state.subscriptionsMutex.Unlock()
-
-	return reg, nil
 }
 
-func registerSubscription(state *state, sub *updateSubscription) (*registeredSubscription, error) {
-	j, err := json.Marshal(sub.Subscription)
+// registerSubscription stores a new registration, whose management token has the given hash.
+func registerSubscription(state *state, sub *updateSubscription, tokenHash string) (*registeredSubscription, error) {
+	err := checkLocations(sub.Locations)
 	if err != nil {
-		return nil, fmt.Errorf("invalid web push subscription object: %w", err)
+		return nil, err
 	}
 
 	id, err := uuid.NewV7()
@@ -598,210 +1008,271 @@ func registerSubscription(state *state, sub *updateSubscription) (*registeredSub
 
 	locs := slices.Compact(sub.Locations)
 
+	var lat, lon sql.NullFloat64
+	if sub.Coordinates != nil {
+		lat = sql.NullFloat64{Float64: float64(sub.Coordinates.Lat), Valid: true}
+		lon = sql.NullFloat64{Float64: float64(sub.Coordinates.Lon), Valid: true}
+	}
+
 	_, err = state.db.Exec(
-		"INSERT INTO subscriptions (id, locations, subscription_json) VALUES (?, ?, ?);",
-		id, strings.Join(locs, ","), string(j),
+		"INSERT INTO subscriptions (id, channel, locations, subscription_json, token_hash, lat, lon, my_location) VALUES (?, ?, ?, ?, ?, ?, ?, nullif(?, ''));",
+		id, sub.Channel, strings.Join(locs, ","), string(sub.config), tokenHash, lat, lon, sub.myLocation,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("unable to insert into subscriptions table: %w", err)
 	}
 
 	reg := registeredSubscription{
-		ID:           id,
-		Subscription: &sub.Subscription,
-		Locations:    locs,
+		ID:          id,
+		Channel:     sub.Channel,
+		Config:      sub.config,
+		Locations:   locs,
+		Coordinates: sub.Coordinates,
+		MyLocation:  sub.myLocation,
 	}
 
-	state.subscriptionsMutex.Lock()
-	for _, l := range sub.Locations {
-		state.subscriptions[l] = append(state.subscriptions[l], &reg)
-	}
-	state.subscriptionsMutex.Unlock()
+	indexRegistration(state, &reg)
 
 	return &reg, nil
 }
 
 func deleteSubscription(state *state, regID uuid.UUID) error {
-	_, err := state.db.Exec("DELETE FROM subscriptions WHERE id = ?", regID)
-	return err
-}
+	res, err := state.db.Exec("DELETE FROM subscriptions WHERE id = ?", regID)
+	if err != nil {
+		return err
+	}
 
-func loadTimeZones() error {
-	for locKey, loc := range supportedLocations {
-		tz, err := time.LoadLocation(loc.ianaName)
-		if err != nil {
-			return fmt.Errorf("failed to load time zone for %v: %w", locKey, err)
-		}
-		loc.tz = tz
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	state.subscriptionsMutex.Lock()
+	for l, subs := range state.subscriptions {
+		state.subscriptions[l] = slices.DeleteFunc(subs, func(s *registeredSubscription) bool {
+			return s.ID == regID
+		})
 	}
+	state.subscriptionsMutex.Unlock()
+
 	return nil
 }
 
 func fetchInitialSummaries(state *state) {
 	var wg sync.WaitGroup
-	for locKey, loc := range supportedLocations {
+	for locKey, loc := range supportedLocations() {
 		wg.Add(1)
 		go func() {
-			ctx, cancel := context.WithCancel(state.ctx)
-			defer cancel()
-
 			defer wg.Done()
+			fetchInitialSummary(state, locKey, loc)
+		}()
+	}
+	wg.Wait()
+}
+
+// fetchInitialSummary loads the cached summary of the location from the database,
+// or generates a new one if there is none.
+func fetchInitialSummary(state *state, locKey string, loc *location) {
+	ctx, cancel := context.WithCancel(state.ctx)
+	defer cancel()
 
-			summary := ""
-			rows, err := state.db.QueryContext(ctx, "SELECT summary FROM summaries WHERE location = ?", locKey)
-			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	summary := ""
+	var updatedAt int64
+	rows, err := state.db.QueryContext(ctx, "SELECT summary, updated_at FROM summaries WHERE location = ?", locKey)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("unable to get cached weather summary", "location", locKey, "error", err)
+	} else if err == nil {
+		defer rows.Close()
+		ok := rows.Next()
+		if ok {
+			err = rows.Scan(&summary, &updatedAt)
+			if err != nil {
 				slog.Warn("unable to get cached weather summary", "location", locKey, "error", err)
-			} else if err == nil {
-				defer rows.Close()
-				ok := rows.Next()
-				if ok {
-					err = rows.Scan(&summary)
-					if err != nil {
-						slog.Warn("unable to get cached weather summary", "location", locKey, "error", err)
-					}
-				}
 			}
+		}
+	}
 
-			if summary == "" {
-				updateSummary(state.ctx, state, updateSummaryOptions{
-					locKey:     locKey,
-					location:   loc,
-					pushUpdate: false,
-				})
-			} else {
-				state.summaries.Store(locKey, summary)
-			}
-		}()
+	if summary == "" {
+		updateSummary(state.ctx, state, updateSummaryOptions{
+			locKey:     locKey,
+			location:   loc,
+			pushUpdate: false,
+		})
+	} else {
+		state.summaries.Store(locKey, summary)
+		if updatedAt > 0 {
+			updateLocationStatus(state, locKey, func(status *locationStatus) {
+				status.lastUpdated = time.Unix(updatedAt, 0)
+			})
+		}
 	}
-	wg.Wait()
 }
 
-func updateSummary(ctx context.Context, state *state, opts updateSummaryOptions) {
+func updateSummary(ctx context.Context, state *state, opts updateSummaryOptions) (err error) {
 	locKey := opts.locKey
 	loc := opts.location
 
+	defer func() {
+		updateLocationStatus(state, locKey, func(status *locationStatus) {
+			if err != nil {
+				status.lastError = err
+				status.lastErrorAt = time.Now()
+			} else {
+				status.lastUpdated = time.Now()
+			}
+		})
+	}()
+
 	slog.Info("updating weather summary", "location", locKey)
 
 	today := time.Now().In(loc.tz)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://api.met.no/weatherapi/locationforecast/2.0/compact?lat=%v&lon=%v", loc.lat, loc.lon), nil)
+	fetchStart := time.Now()
+	fetchCtx, span := tracer.Start(ctx, "met.fetch_forecast", trace.WithAttributes(attribute.String("location", locKey)))
+	data, err := fetchForecast(fetchCtx, state.metAPIUserAgent, loc)
+	endSpan(span, err)
+	metFetchDuration.Observe(time.Since(fetchStart).Seconds())
+	metFetchesTotal.WithLabelValues(locKey, resultLabel(err)).Inc()
 	if err != nil {
 		slog.Error("failed to query weather data", "location", locKey, "error", err)
-		return
+		return err
 	}
-	req.Header.Set("User-Agent", state.metAPIUserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		slog.Error("failed to query weather data", "location", locKey, "error", err)
-		return
+	input := summaryInput{
+		locKey:     locKey,
+		location:   loc,
+		today:      today,
+		timeSeries: todaysTimeSeries(data, loc, today),
 	}
 
-	defer resp.Body.Close()
-
-	data := metAPIData{}
-	err = json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		slog.Error("failed to decode received weather data", "location", locKey, "error", err)
-		return
-	}
-
-	y, m, d := today.Date()
-
-	t := slices.DeleteFunc(data.Properties.TimeSeries, func(series map[string]any) bool {
-		if ts, ok := series["time"].(string); ok {
-			t, err := time.Parse(time.RFC3339, ts)
-			if err != nil {
-				return false
-			}
-			ty, tm, td := t.In(loc.tz).Date()
-			return !(y == ty && m == tm && d == td)
+	advisory := ""
+	if state.airQuality != nil {
+		aq, err := state.airQuality.fetchAirQuality(ctx, loc, today)
+		if err != nil {
+			slog.Warn("failed to query air quality data", "location", locKey, "error", err)
+		} else if aq != nil {
+			input.airQuality = aq
+			advisory = aq.advisory(state.airQualityThreshold)
 		}
-		return false
-	})
-
-	b, err := json.Marshal(t)
-	if err != nil {
-		slog.Error("failed to marshal processed time series data", "location", locKey, "error", err)
-		return
 	}
 
-	weatherJSON := string(b)
+	start := time.Now()
 
-	result, err := state.genai.Models.GenerateContent(ctx, "gemini-2.0-flash", []*genai.Content{{
-		Parts: []*genai.Part{
-			{Text: fmt.Sprintf(prompt, today.Format("2006-02-01"), loc.displayName, loc.displayName)},
-			{Text: weatherJSON},
-		},
-	}}, nil)
+	summary, err := generateValidSummary(ctx, state, input)
 	if err != nil {
 		slog.Error("failed to generate weather summary", "location", locKey, "error", err)
-		return
+		return err
 	}
 
-	summary := result.Text()
+	var forecast *forecastStats
+	if stats, ok := computeForecastStats(input.timeSeries); ok {
+		forecast = &stats
+	}
 
+	latency := time.Since(start)
+	summaryGenerationDuration.Observe(latency.Seconds())
+	updateLocationStatus(state, locKey, func(status *locationStatus) {
+		status.lastLatency = latency
+		status.lastAdvisory = advisory
+		status.lastForecast = forecast
+	})
+
+	dbCtx, span := tracer.Start(ctx, "db.store_summary", trace.WithAttributes(attribute.String("location", locKey)))
 	state.dbMutex.Lock()
-	_, err = state.db.ExecContext(ctx, "INSERT OR REPLACE INTO summaries (location, summary) VALUES (?, ?)", locKey, summary)
+	_, err = state.db.ExecContext(dbCtx, "INSERT OR REPLACE INTO summaries (location, summary, updated_at) VALUES (?, ?, ?)", locKey, summary, time.Now().Unix())
 	if err != nil {
 		slog.Warn("unable to cache generated weather summary to db", "location", locKey, "error", err)
 	}
 	state.dbMutex.Unlock()
+	endSpan(span, err)
 
 	state.summaries.Store(locKey, summary)
 
 	if opts.pushUpdate {
-		c := state.summaryChans[locKey]
-		if len(state.subscriptions[locKey]) > 0 {
-			c <- summary
+		state.subscriptionsMutex.Lock()
+		hasSubscribers := len(state.subscriptions[locKey]) > 0
+		state.subscriptionsMutex.Unlock()
+
+		if hasSubscribers {
+			pushSummaryUpdate(state, locKey, summaryUpdate{
+				summary:     summary,
+				advisory:    advisory,
+				forecast:    forecast,
+				spanContext: trace.SpanContextFromContext(ctx),
+			})
 		}
 	}
 
 	slog.Info("updated weather summary", "location", locKey)
+
+	return nil
+}
+
+// updateLocationStatus calls update with the status of the location while holding locationStatusesMutex.
+func updateLocationStatus(state *state, locKey string, update func(status *locationStatus)) {
+	state.locationStatusesMutex.Lock()
+	defer state.locationStatusesMutex.Unlock()
+
+	status, ok := state.locationStatuses[locKey]
+	if !ok {
+		status = &locationStatus{}
+		state.locationStatuses[locKey] = status
+	}
+
+	update(status)
 }
 
-func listenForSummaryUpdates(state *state, locKey string, c <-chan string) {
-	opts := webpush.Options{
+func webpushOptions(state *state) *webpush.Options {
+	return &webpush.Options{
 		Subscriber:      state.vapidSubject,
 		VAPIDPublicKey:  state.vapidPublicKey,
 		VAPIDPrivateKey: state.vapidPrivateKey,
 		TTL:             30,
+		HTTPClient:      httpClient,
 	}
+}
 
-	for {
-		select {
-		case summary := <-c:
-			payload := webpushNotificationPayload{
-				Summary:  summary,
-				Location: locKey,
-			}
-			b, err := json.Marshal(&payload)
-			if err != nil {
-				slog.Error("failed to create web push notification payload", "location", locKey, "error", err)
-				continue
-			}
+// listenForSummaryUpdates delivers every summary update received from c to the subscribers of the location,
+// until ctx is cancelled. A listener that panics is restarted, so that updates of the location are still received.
+func listenForSummaryUpdates(ctx context.Context, state *state, locKey string, c <-chan summaryUpdate) {
+	updateLocationStatus(state, locKey, func(status *locationStatus) {
+		status.listenerRunning = true
+	})
+	defer updateLocationStatus(state, locKey, func(status *locationStatus) {
+		status.listenerRunning = false
+	})
 
-			subs := state.subscriptions[locKey]
+	for ctx.Err() == nil {
+		receiveSummaryUpdates(ctx, state, locKey, c)
+	}
+}
 
-			slog.Info("pushing weather summary to subscribers", "count", len(subs), "location", locKey)
+// receiveSummaryUpdates delivers summary updates received from c until ctx is cancelled, or a delivery panics.
+func receiveSummaryUpdates(ctx context.Context, state *state, locKey string, c <-chan summaryUpdate) {
+	defer func() {
+		// a panicking listener should only drop the update that it was delivering
+		if r := recover(); r != nil {
+			slog.Error("push listener crashed, restarting", "location", locKey, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
 
-			var wg sync.WaitGroup
-			for _, sub := range subs {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					_, err := webpush.SendNotificationWithContext(state.ctx, b, sub.Subscription, &opts)
-					if err != nil {
-						slog.Warn("unable to send web push to subscription", "id", sub.ID, "location", locKey, "error", err)
-					}
-				}()
-			}
+	for {
+		select {
+		case update := <-c:
+			pushCtx := trace.ContextWithSpanContext(state.ctx, update.spanContext)
 
-			wg.Wait()
+			succeeded, failed := fanOutSummary(pushCtx, state, locKey, update)
 
-			slog.Info("pushed weather summary to subscribers", "count", len(subs), "location", locKey)
+			updateLocationStatus(state, locKey, func(status *locationStatus) {
+				status.lastPushAt = time.Now()
+				status.pushesSucceeded += succeeded
+				status.pushesFailed += failed
+			})
 
-		case <-state.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
 	}
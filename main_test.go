@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestState returns a state with an empty database in a temporary directory, and the built-in locations.
+func newTestState(t *testing.T) *state {
+	t.Helper()
+
+	db, err := initDB("file:" + filepath.Join(t.TempDir(), "data.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to initialize db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	err = initLocations("")
+	if err != nil {
+		t.Fatalf("failed to load locations: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &state{
+		ctx:              ctx,
+		db:               db,
+		locationStatuses: map[string]*locationStatus{},
+		locationJobs:     map[string]*locationJob{},
+		subscriptions:    map[string][]*registeredSubscription{},
+		notifiers:        map[string]Notifier{},
+	}
+}
+
+func TestSummaryPageDeliveryTime(t *testing.T) {
+	state := newTestState(t)
+	summaryHTML, _ := webDir.ReadFile("web/summary.html")
+	state.template.summary = template.Must(template.New("summary.html").Parse(string(summaryHTML)))
+
+	london, _ := lookupLocation("london")
+	early := *london
+	early.deliveryHour, early.deliveryMinute = 6, 30
+	setConfiguredLocations(map[string]*location{"london": &early})
+	state.summaries.Store("london", "Good morning, London!")
+
+	rec := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/london", nil)
+	request.SetPathValue("path", "london")
+	handlePage(state)(rec, request)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("summary page responded with %v", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `data-delivery-time="06:30">Get daily summary at 06:30</button>`) {
+		t.Errorf("summary page does not show the delivery time of london:\n%v", body)
+	}
+}
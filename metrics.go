@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metFetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sevenam_met_fetches_total",
+		Help: "Number of forecast fetches from the MET API, by result.",
+	}, []string{"location", "result"})
+
+	metFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sevenam_met_fetch_duration_seconds",
+		Help:    "Latency of forecast fetches from the MET API.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	geminiCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sevenam_gemini_calls_total",
+		Help: "Number of content generation calls to Gemini, by result.",
+	}, []string{"result"})
+
+	geminiTokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sevenam_gemini_tokens_total",
+		Help: "Number of Gemini tokens used, by type.",
+	}, []string{"type"})
+
+	summaryGenerationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sevenam_summary_generation_duration_seconds",
+		Help:    "Latency of generating a valid summary, including retries.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60},
+	})
+
+	webpushSendsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sevenam_webpush_sends_total",
+		Help: `Number of web pushes sent, by the status code of the push service. The status is "error" if no response was received.`,
+	}, []string{"status"})
+
+	webpushSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sevenam_webpush_send_duration_seconds",
+		Help:    "Latency of sending a single web push.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	deliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sevenam_deliveries_total",
+		Help: "Number of summary deliveries to registrations, by channel and result. Retries are not counted separately.",
+	}, []string{"channel", "result"})
+
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sevenam_delivery_duration_seconds",
+		Help:    "Latency of delivering a summary to a single registration, including retries.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30},
+	}, []string{"channel"})
+
+	registrationsCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sevenam_registrations_created_total",
+		Help: "Number of registrations created.",
+	})
+
+	registrationsDeletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sevenam_registrations_deleted_total",
+		Help: "Number of registrations deleted.",
+	})
+)
+
+// stateCollector collects gauges that are derived from the server state at scrape time.
+type stateCollector struct {
+	state *state
+
+	subscribers *prometheus.Desc
+	summaryAge  *prometheus.Desc
+}
+
+func newStateCollector(state *state) *stateCollector {
+	return &stateCollector{
+		state: state,
+		subscribers: prometheus.NewDesc(
+			"sevenam_subscribers",
+			"Number of registrations subscribed to a location.",
+			[]string{"location"}, nil,
+		),
+		summaryAge: prometheus.NewDesc(
+			"sevenam_summary_age_seconds",
+			"Time since the summary of a location was last updated.",
+			[]string{"location"}, nil,
+		),
+	}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.subscribers
+	ch <- c.summaryAge
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.state.subscriptionsMutex.Lock()
+	for locKey := range supportedLocations() {
+		ch <- prometheus.MustNewConstMetric(c.subscribers, prometheus.GaugeValue, float64(len(c.state.subscriptions[locKey])), locKey)
+	}
+	c.state.subscriptionsMutex.Unlock()
+
+	c.state.locationStatusesMutex.Lock()
+	for locKey, status := range c.state.locationStatuses {
+		if !status.lastUpdated.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.summaryAge, prometheus.GaugeValue, time.Since(status.lastUpdated).Seconds(), locKey)
+		}
+	}
+	c.state.locationStatusesMutex.Unlock()
+}
+
+// resultLabel returns the value of the "result" label for an operation that returned err.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// pushStatusLabel returns the value of the "status" label of sevenam_webpush_sends_total.
+func pushStatusLabel(statusCode int, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(statusCode)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// gridResolution is the size of the cells of grid locations in degrees, which is about 28 km at the equator
+	gridResolution = 0.25
+	// maxGridPlaceKm is the maximum distance of the place that a grid location is named after
+	maxGridPlaceKm = 50
+)
+
+// coordinates is a position sent by the browser
+type coordinates struct {
+	Lat float32 `json:"lat"`
+	Lon float32 `json:"lon"`
+}
+
+// nearestLocationResponse is the response body of POST /api/locations/nearest
+type nearestLocationResponse struct {
+	Location apiLocation `json:"location"`
+	// DistanceKm is the distance between the coordinates and the location
+	DistanceKm float64 `json:"distanceKm"`
+	// Summary is the latest summary of the location, or empty if it has none yet
+	Summary string `json:"summary,omitempty"`
+}
+
+func (c coordinates) validate() error {
+	if math.IsNaN(float64(c.Lat)) || math.IsNaN(float64(c.Lon)) || c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180 {
+		return errors.New("coordinates are out of range")
+	}
+	return nil
+}
+
+// nearestLocation returns the key of the supported location closest to the coordinates, and its distance.
+func nearestLocation(lat, lon float32) (string, float64, bool) {
+	nearest := ""
+	nearestDistance := math.Inf(1)
+	for locKey, loc := range supportedLocations() {
+		d := distanceKm(lat, lon, loc.lat, loc.lon)
+		if d < nearestDistance {
+			nearest, nearestDistance = locKey, d
+		}
+	}
+	return nearest, nearestDistance, nearest != ""
+}
+
+// gridLocationConfig returns the grid location of the cell that contains c.
+// It is named after the largest place near the center of the cell, and uses the time zone of the closest place.
+func gridLocationConfig(state *state, c coordinates) *locationConfig {
+	lat := float32(math.Round(float64(c.Lat)/gridResolution) * gridResolution)
+	lon := float32(math.Round(float64(c.Lon)/gridResolution) * gridResolution)
+	if lon == 180 {
+		lon = -180
+	}
+
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns = "S"
+	}
+	if lon < 0 {
+		ew = "W"
+	}
+	absLat, absLon := math.Abs(float64(lat)), math.Abs(float64(lon))
+
+	config := &locationConfig{
+		Key: fmt.Sprintf("grid-%v%04d-%v%05d", strings.ToLower(ns), int(math.Round(absLat*100)), strings.ToLower(ew), int(math.Round(absLon*100))),
+		// the name is mentioned in the summary, so coordinates are only used if there is no place to name the location after
+		Name: fmt.Sprintf("%.2f°%v, %.2f°%v", absLat, ns, absLon, ew),
+		Lat:  lat,
+		Lon:  lon,
+	}
+
+	if p, _ := state.gazetteer.nearestPlace(lat, lon); p != nil {
+		config.Timezone = p.timezone
+	}
+	if p := state.gazetteer.largestPlaceWithin(lat, lon, maxGridPlaceKm); p != nil {
+		config.Name = p.name
+	}
+
+	return config
+}
+
+// snapCoordinates returns the key of the location whose summary is used for c.
+// c snaps to the closest supported location if it is within sameLocationRadiusKm.
+// Otherwise, the grid location of c is used, which is created if it does not exist yet and beforeCreate returns true.
+// If the grid location cannot be created, the closest supported location is used regardless of its distance.
+// created is true if the grid location was created.
+func snapCoordinates(state *state, c coordinates, beforeCreate func() bool) (locKey string, created bool, err error) {
+	locKey, d, ok := nearestLocation(c.Lat, c.Lon)
+	if ok && d <= sameLocationRadiusKm {
+		return locKey, false, nil
+	}
+
+	grid := gridLocationConfig(state, c)
+	if _, exists := lookupLocation(grid.Key); exists {
+		return grid.Key, false, nil
+	}
+
+	if grid.Timezone != "" && dynamicLocationCount() < state.maxDynamicLocations && beforeCreate() {
+		created, err := createDynamicLocation(state, grid)
+		if err == nil {
+			return grid.Key, created, nil
+		}
+		if !errors.Is(err, errDynamicLocationLimit) {
+			return "", false, err
+		}
+	}
+
+	if !ok {
+		return "", false, errors.New("there are no locations")
+	}
+	return locKey, false, nil
+}
+
+// resolveMyLocation snaps the coordinates of a registration to a location, and subscribes the registration to it.
+// Creating a grid location for the coordinates is rate limited with limiter, which responds with 429 if the limit is exceeded,
+// in which case limited is true.
+func resolveMyLocation(state *state, update *updateSubscription, limiter *rateLimiter, writer http.ResponseWriter, request *http.Request) (limited bool, err error) {
+	if update.Coordinates == nil {
+		return false, nil
+	}
+
+	locKey, created, err := snapCoordinates(state, *update.Coordinates, func() bool {
+		limited = !allowRequest(state, limiter, writer, request)
+		return !limited
+	})
+	if limited || err != nil {
+		return limited, err
+	}
+
+	update.myLocation = locKey
+	update.createdMyLocation = created
+	if !slices.Contains(update.Locations, locKey) {
+		update.Locations = append(update.Locations, locKey)
+	}
+	update.RemoveLocations = slices.DeleteFunc(update.RemoveLocations, func(l string) bool { return l == locKey })
+
+	return false, nil
+}
+
+// discardMyLocation removes the grid location that resolveMyLocation created for a registration request that failed afterwards.
+// It is kept if another registration has subscribed to it in the meantime.
+func discardMyLocation(state *state, update *updateSubscription) {
+	if !update.createdMyLocation {
+		return
+	}
+
+	state.subscriptionsMutex.Lock()
+	subscribers := len(state.subscriptions[update.myLocation])
+	state.subscriptionsMutex.Unlock()
+	if subscribers > 0 {
+		return
+	}
+
+	err := removeDynamicLocation(state, update.myLocation)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("failed to remove location of failed registration", "location", update.myLocation, "error", err)
+	}
+}
+
+func handleNearestLocation(state *state, limiter *rateLimiter) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		logger := requestLogger(request)
+
+		defer request.Body.Close()
+
+		c := coordinates{}
+		err := json.NewDecoder(request.Body).Decode(&c)
+		if err != nil {
+			writeRequestBodyError(writer, err)
+			return
+		}
+		err = c.validate()
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), nil)
+			return
+		}
+
+		// only creating a grid location is rate limited, since it generates a summary
+		limited := false
+		locKey, _, err := snapCoordinates(state, c, func() bool {
+			limited = !allowRequest(state, limiter, writer, request)
+			return !limited
+		})
+		if limited {
+			return
+		}
+		if err != nil {
+			logger.Error("failed to find nearest location", "error", err)
+			writeInternalError(writer)
+			return
+		}
+
+		loc, ok := lookupLocation(locKey)
+		if !ok {
+			writeError(writer, http.StatusNotFound, errCodeUnknownLocation, "unknown location "+locKey, nil)
+			return
+		}
+
+		res := nearestLocationResponse{
+			DistanceKm: distanceKm(c.Lat, c.Lon, loc.lat, loc.lon),
+		}
+		state.subscriptionsMutex.Lock()
+		res.Location = newAPILocation(state, locKey, loc)
+		state.subscriptionsMutex.Unlock()
+		if summary, ok := state.summaries.Load(locKey); ok {
+			res.Summary = summary.(string)
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(res)
+	}
+}
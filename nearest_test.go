@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSameLocationRadius(t *testing.T) {
+	state := newTestState(t)
+	g, err := loadGazetteer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.gazetteer = g
+	state.maxDynamicLocations = 1
+
+	london, _ := lookupLocation("london")
+	// a degree of latitude is about 111 km
+	for _, tc := range []struct {
+		km   float32
+		same bool
+	}{
+		{5, true},
+		{sameLocationRadiusKm - 2, true},
+		{sameLocationRadiusKm + 2, false},
+		{40, false},
+	} {
+		lat := london.lat + tc.km/111
+
+		locKey, ok := nearestSupportedLocation(&place{key: "somewhere-gb", lat: lat, lon: london.lon})
+		if ok != tc.same || (ok && locKey != "london") {
+			t.Errorf("a place %v km from london is covered by %q, %v", tc.km, locKey, ok)
+		}
+
+		// coordinates that are not covered by london would get a grid location
+		wantsGrid := false
+		locKey, _, err := snapCoordinates(state, coordinates{Lat: lat, Lon: london.lon}, func() bool {
+			wantsGrid = true
+			return false
+		})
+		if err != nil || locKey != "london" {
+			t.Errorf("coordinates %v km from london snapped to %q, %v", tc.km, locKey, err)
+		}
+		if wantsGrid == tc.same {
+			t.Errorf("coordinates %v km from london were snapped to london: %v, expected %v", tc.km, !wantsGrid, tc.same)
+		}
+	}
+}
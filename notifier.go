@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	channelWebPush  = "webpush"
+	channelEmail    = "email"
+	channelWebhook  = "webhook"
+	channelTelegram = "telegram"
+	channelNtfy     = "ntfy"
+	channelGotify   = "gotify"
+)
+
+const (
+	// maxDeliveryAttempts is the number of times a delivery is attempted before it is given up
+	maxDeliveryAttempts = 3
+	// deliveryRetryDelay is the delay before the first retry of a failed delivery. it doubles with every retry.
+	deliveryRetryDelay = 2 * time.Second
+	// maxConcurrentDeliveries is the number of deliveries of a summary update that run at the same time
+	maxConcurrentDeliveries = 32
+)
+
+// Notifier delivers summaries to the registrations of a delivery channel
+type Notifier interface {
+	// ValidateConfig checks the channel config of a registration request, and returns the config that is stored.
+	ValidateConfig(config json.RawMessage) (json.RawMessage, error)
+	// Notify delivers n to a single registration.
+	// A *deliveryError is returned if the receiving service rejected the delivery.
+	Notify(ctx context.Context, reg *registeredSubscription, n *notification) error
+}
+
+// notification is a summary that is delivered to the registrations of a location
+type notification struct {
+	locKey   string
+	location *location
+	summary  string
+	// advisory is an optional warning, such as poor air quality
+	advisory string
+	// forecast is the forecast of the day that the summary is based on, or nil if it is not known
+	forecast *forecastStats
+}
+
+// deliveryError is returned by a Notifier when the receiving service rejected a delivery
+type deliveryError struct {
+	// statusCode is the status code returned by the service, or 0 if it has none
+	statusCode int
+	// permanent is set if retrying the delivery will not help, e.g. because the subscription has expired
+	permanent bool
+	// gone is set if the registration can not be delivered to ever again, e.g. because the subscription has expired
+	// or the mailbox does not exist, in which case the registration is deleted. gone implies permanent.
+	gone bool
+	err  error
+}
+
+func (e *deliveryError) Error() string {
+	if e.statusCode != 0 {
+		return fmt.Sprintf("delivery rejected with status %d: %v", e.statusCode, e.err)
+	}
+	return fmt.Sprintf("delivery rejected: %v", e.err)
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// deliver sends n to reg with the notifier of its channel.
+// Failed deliveries are retried with exponential backoff, unless the error is permanent.
+func deliver(ctx context.Context, state *state, reg *registeredSubscription, n *notification) error {
+	notifier, ok := state.notifiers[reg.Channel]
+	if !ok {
+		return fmt.Errorf("channel %v is not enabled", reg.Channel)
+	}
+
+	ctx, span := tracer.Start(ctx, "notifier.send", trace.WithAttributes(
+		attribute.String("location", n.locKey),
+		attribute.String("registration.id", reg.ID.String()),
+		attribute.String("channel", reg.Channel),
+	))
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		deliveryDuration.WithLabelValues(reg.Channel).Observe(time.Since(start).Seconds())
+	}()
+
+	delay := deliveryRetryDelay
+	var err error
+attempts:
+	for attempt := 1; attempt <= maxDeliveryAttempts; attempt++ {
+		err = notifier.Notify(ctx, reg, n)
+		if err == nil {
+			span.SetAttributes(attribute.Int("attempts", attempt))
+			return nil
+		}
+
+		var deliveryErr *deliveryError
+		if (errors.As(err, &deliveryErr) && deliveryErr.permanent) || attempt == maxDeliveryAttempts {
+			break
+		}
+
+		slog.Debug("retrying failed delivery", "id", reg.ID, "channel", reg.Channel, "location", n.locKey, "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			err = ctx.Err()
+			break attempts
+		}
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+// fanOutSummary delivers the summary update of a location to every registration that is subscribed to it,
+// and returns the number of successful and failed deliveries.
+func fanOutSummary(ctx context.Context, state *state, locKey string, update summaryUpdate) (succeeded int, failed int) {
+	loc, ok := lookupLocation(locKey)
+	if !ok {
+		return 0, 0
+	}
+
+	state.subscriptionsMutex.Lock()
+	regs := slices.Clone(state.subscriptions[locKey])
+	state.subscriptionsMutex.Unlock()
+
+	// registrations of a channel that has been disabled since they were created are kept, but skipped
+	regs = slices.DeleteFunc(regs, func(reg *registeredSubscription) bool {
+		_, ok := state.notifiers[reg.Channel]
+		return !ok
+	})
+
+	n := &notification{
+		locKey:   locKey,
+		location: loc,
+		summary:  update.summary,
+		advisory: update.advisory,
+		forecast: update.forecast,
+	}
+
+	slog.Info("delivering weather summary to subscribers", "count", len(regs), "location", locKey)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	// gone registrations are deleted after every delivery finished, so that the database is not written to while holding mu
+	var gone []*registeredSubscription
+	sem := make(chan struct{}, maxConcurrentDeliveries)
+	for _, reg := range regs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := deliver(ctx, state, reg, n)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				deliveriesTotal.WithLabelValues(reg.Channel, "error").Inc()
+				slog.Warn("unable to deliver summary", "id", reg.ID, "channel", reg.Channel, "location", locKey, "error", err)
+
+				var deliveryErr *deliveryError
+				if errors.As(err, &deliveryErr) && deliveryErr.gone {
+					gone = append(gone, reg)
+				}
+				return
+			}
+			succeeded++
+			deliveriesTotal.WithLabelValues(reg.Channel, "ok").Inc()
+		}()
+	}
+	wg.Wait()
+
+	for _, reg := range gone {
+		deleteGoneRegistration(state, reg)
+	}
+
+	slog.Info("delivered weather summary to subscribers", "succeeded", succeeded, "failed", failed, "location", locKey)
+
+	return succeeded, failed
+}
+
+// deleteGoneRegistration deletes a registration whose delivery failed with a gone *deliveryError,
+// so that it is not delivered to again every day.
+func deleteGoneRegistration(state *state, reg *registeredSubscription) {
+	err := deleteSubscription(state, reg.ID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to delete registration that can no longer be delivered to", "id", reg.ID, "channel", reg.Channel, "error", err)
+		}
+		return
+	}
+	registrationsDeletedTotal.Inc()
+	slog.Info("deleted registration that can no longer be delivered to", "id", reg.ID, "channel", reg.Channel)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// fakeNotifier fails the deliveries to the registrations in errs with their error, and records the others.
+type fakeNotifier struct {
+	errs map[uuid.UUID]error
+
+	mu        sync.Mutex
+	delivered []uuid.UUID
+}
+
+func (f *fakeNotifier) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	return config, nil
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	if err, ok := f.errs[reg.ID]; ok {
+		return err
+	}
+	f.mu.Lock()
+	f.delivered = append(f.delivered, reg.ID)
+	f.mu.Unlock()
+	return nil
+}
+
+func TestFanOutSummaryDeletesGoneRegistrations(t *testing.T) {
+	state := newTestState(t)
+
+	ok, gone, rejected := uuid.New(), uuid.New(), uuid.New()
+	notifier := &fakeNotifier{errs: map[uuid.UUID]error{
+		gone:     &deliveryError{statusCode: 410, permanent: true, gone: true, err: errors.New("subscription expired")},
+		rejected: &deliveryError{statusCode: 400, permanent: true, err: errors.New("malformed push")},
+	}}
+	state.notifiers[channelWebhook] = notifier
+
+	for _, id := range []uuid.UUID{ok, gone, rejected} {
+		err := insertChannelRegistration(state.db, id.String(), channelWebhook, "london", map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexRegistration(state, &registeredSubscription{ID: id, Channel: channelWebhook, Locations: []string{"london"}})
+	}
+
+	succeeded, failed := fanOutSummary(context.Background(), state, "london", summaryUpdate{summary: "It is sunny in London today."})
+	if succeeded != 1 || failed != 2 {
+		t.Errorf("expected 1 successful and 2 failed deliveries, got %v and %v", succeeded, failed)
+	}
+
+	for id, wantKept := range map[uuid.UUID]bool{ok: true, gone: false, rejected: true} {
+		var n int
+		err := state.db.QueryRow("SELECT count(*) FROM subscriptions WHERE id = ?", id).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := n == 1; kept != wantKept {
+			t.Errorf("registration %v was kept: %v, expected %v", id, kept, wantKept)
+		}
+	}
+	if len(state.subscriptions["london"]) != 2 {
+		t.Errorf("expected 2 subscribers of london to be left, got %v", len(state.subscriptions["london"]))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// promptData stores the variables that are available to prompt templates
+type promptData struct {
+	// Location is the display name of the location
+	Location string
+	// LocationKey is the key of the location in supportedLocations
+	LocationKey string
+	// Date is the local date of the location, formatted as YYYY-MM-DD
+	Date string
+	// Units describes the temperature units that the summary should use
+	Units string
+	// Language is the language that the summary should be written in
+	Language string
+	// DigestType describes the kind of summary that is generated, e.g. "daily"
+	DigestType string
+}
+
+// defaults of the prompt variables that can be configured with PROMPT_UNITS, PROMPT_LANGUAGE, and PROMPT_DIGEST_TYPE
+const (
+	defaultPromptUnits      = "celsius and fahrenheit"
+	defaultPromptLanguage   = "English"
+	defaultPromptDigestType = "daily"
+)
+
+// promptSet stores the compiled prompt templates
+type promptSet struct {
+	fallback *template.Template
+	// variants maps location keys to location-specific prompt templates
+	variants map[string]*template.Template
+
+	// units, language, and digestType are the values of the prompt variables of the same name,
+	// unless a location overrides them
+	units      string
+	language   string
+	digestType string
+}
+
+// loadPrompts compiles the embedded default prompt, then loads overrides from dir if it is not empty.
+// In dir, prompt.txt replaces the default prompt,
+// and prompt.<location key>.txt replaces the prompt for that location only, which is resolved when the prompt is rendered.
+// The defaults of the prompt variables are read from PROMPT_UNITS, PROMPT_LANGUAGE, and PROMPT_DIGEST_TYPE.
+func loadPrompts(dir string) (*promptSet, error) {
+	fallback, err := template.New("prompt.txt").Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded prompt: %w", err)
+	}
+
+	set := &promptSet{
+		fallback:   fallback,
+		variants:   map[string]*template.Template{},
+		units:      cmp.Or(os.Getenv("PROMPT_UNITS"), defaultPromptUnits),
+		language:   cmp.Or(os.Getenv("PROMPT_LANGUAGE"), defaultPromptLanguage),
+		digestType: cmp.Or(os.Getenv("PROMPT_DIGEST_TYPE"), defaultPromptDigestType),
+	}
+
+	if dir == "" {
+		return set, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("prompt directory %v does not exist", dir)
+		}
+		return nil, fmt.Errorf("failed to read prompt directory %v: %w", dir, err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, "prompt.") || filepath.Ext(name) != ".txt" {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt %v: %w", name, err)
+		}
+
+		t, err := template.New(name).Option("missingkey=error").Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prompt %v: %w", name, err)
+		}
+
+		// variants are kept even if their location does not exist yet, since locations can be added
+		// from the gazetteer or the locations file while the server is running
+		locKey := strings.TrimSuffix(strings.TrimPrefix(name, "prompt."), ".txt")
+		if name == "prompt.txt" {
+			set.fallback = t
+		} else {
+			set.variants[locKey] = t
+			if _, ok := lookupLocation(locKey); !ok {
+				slog.Info("prompt override loaded for a location that does not exist yet", "file", name)
+				continue
+			}
+		}
+
+		slog.Info("prompt override loaded", "file", name)
+	}
+
+	return set, nil
+}
+
+// newPromptData creates promptData for the given location.
+// The units and language of the location take precedence over the defaults of the prompt set.
+func (p *promptSet) newPromptData(locKey string, loc *location, date string) promptData {
+	return promptData{
+		Location:    loc.displayName,
+		LocationKey: locKey,
+		Date:        date,
+		Units:       cmp.Or(loc.units, p.units),
+		Language:    cmp.Or(loc.language, p.language),
+		DigestType:  p.digestType,
+	}
+}
+
+// render renders the prompt for the location in data, using its variant if there is one.
+func (p *promptSet) render(data promptData) (string, error) {
+	t, ok := p.variants[data.LocationKey]
+	if !ok {
+		t = p.fallback
+	}
+
+	var sb strings.Builder
+	err := t.Execute(&sb, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render prompt %v: %w", t.Name(), err)
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPromptVariantOfLaterLocation(t *testing.T) {
+	newTestState(t)
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"prompt.london.txt":    "london prompt for {{.Location}}",
+		"prompt.krakow-pl.txt": "krakow prompt for {{.Location}}",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set, err := loadPrompts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// krakow-pl does not exist when the prompts are loaded, and is added from the gazetteer afterwards
+	loc, err := (&locationConfig{Key: "krakow-pl", Name: "Kraków", Lat: 50.06143, Lon: 19.93658, Timezone: "Europe/Warsaw"}).toLocation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	london, _ := lookupLocation("london")
+	sf, _ := lookupLocation("sf")
+
+	for _, tc := range []struct {
+		locKey string
+		loc    *location
+		want   string
+	}{
+		{"london", london, "london prompt for London"},
+		{"krakow-pl", loc, "krakow prompt for Kraków"},
+	} {
+		got, err := set.render(set.newPromptData(tc.locKey, tc.loc, "2026-01-15"))
+		if err != nil || got != tc.want {
+			t.Errorf("prompt of %v is %q, %v, expected %q", tc.locKey, got, err, tc.want)
+		}
+	}
+
+	// other locations use the embedded prompt
+	got, err := set.render(set.newPromptData("sf", sf, "2026-01-15"))
+	if err != nil || got == "" || got == "london prompt for San Francisco" {
+		t.Errorf("prompt of sf is %q, %v", got, err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// registrationRateLimit is the number of registration requests a single ip address can make per second in the long run
+	registrationRateLimit = 1.0 / 10
+	// registrationRateBurst is the number of registration requests a single ip address can make in quick succession
+	registrationRateBurst = 10
+	// maxRegistrationBodySize is the maximum size of the request body of registration endpoints.
+	// a web push subscription is a few hundred bytes.
+	maxRegistrationBodySize = 8 << 10
+
+	// locationRateLimit is the number of locations a single ip address can add per second in the long run.
+	// adding a location generates a summary, so it is limited more strictly than registrations.
+	locationRateLimit = 1.0 / 300
+	// locationRateBurst is the number of locations a single ip address can add in quick succession
+	locationRateBurst = 3
+	// maxLocationBodySize is the maximum size of the request body of POST /api/locations
+	maxLocationBodySize = 1 << 10
+
+	// emailRateLimit is the number of confirmation emails a single ip address can request per second in the long run.
+	// every request sends an email to an address of the client's choosing, so it is limited far more strictly than registrations.
+	emailRateLimit = 1.0 / 3600
+	// emailRateBurst is the number of confirmation emails a single ip address can request in quick succession
+	emailRateBurst = 3
+)
+
+// tokenBucket holds the tokens left for a single client
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per-key token bucket rate limiter.
+// Each key may make burst requests at once, and rate requests per second after that.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key.
+// If the bucket is empty, it returns false and how long it takes for the next token to be available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst}
+		l.buckets[key] = b
+	} else {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+	}
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes buckets that have been refilled completely, since they are the same as a new bucket.
+// it runs at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit rejects requests with 429 once the client ip has used up its tokens in limiter.
+func rateLimit(state *state, limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if allowRequest(state, limiter, writer, request) {
+			next(writer, request)
+		}
+	}
+}
+
+// allowRequest takes a token of the client ip from limiter. If there is none left, it responds with 429 and returns false.
+// It is used by handlers that only rate limit some of their requests.
+func allowRequest(state *state, limiter *rateLimiter, writer http.ResponseWriter, request *http.Request) bool {
+	ip := clientIP(request, state.trustedProxies)
+
+	ok, retryAfter := limiter.allow(ip)
+	if !ok {
+		requestLogger(request).Warn("rate limit exceeded", "remoteIP", ip, "path", request.URL.Path)
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(writer, http.StatusTooManyRequests, errCodeRateLimited, "too many requests, try again later",
+			map[string]int{"retryAfter": seconds})
+		return false
+	}
+
+	return true
+}
+
+// limitBody caps the size of the request body, so that reading past maxBytes fails.
+func limitBody(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		request.Body = http.MaxBytesReader(writer, request.Body, maxBytes)
+		next(writer, request)
+	}
+}
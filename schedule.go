@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-co-op/gocron/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// locationJob is the scheduled summary update and the push listener of a location
+type locationJob struct {
+	scheduler gocron.Scheduler
+	job       gocron.Job
+	// updates is the channel that the push listener receives summary updates from
+	updates chan summaryUpdate
+	// ctx is cancelled when the location is removed, which stops the push listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	// listenerDone is closed once the push listener has returned
+	listenerDone chan struct{}
+	// location is the location that the job was scheduled for
+	location *location
+}
+
+// startLocation schedules the daily summary update of the location, and starts its push listener.
+// It fails if the location is already running, which has to be stopped first.
+func startLocation(state *state, locKey string, loc *location) error {
+	s, err := gocron.NewScheduler(gocron.WithLocation(loc.tz))
+	if err != nil {
+		return fmt.Errorf("failed to create gocron scheduler for %v: %w", locKey, err)
+	}
+
+	job, err := s.NewJob(
+		gocron.DailyJob(1, gocron.NewAtTimes(gocron.NewAtTime(loc.deliveryHour, loc.deliveryMinute, 0))),
+		gocron.NewTask(func(ctx context.Context) {
+			// the display name may have changed since the job was scheduled
+			loc, ok := lookupLocation(locKey)
+			if !ok {
+				return
+			}
+			ctx, span := tracer.Start(ctx, "scheduled summary update", trace.WithAttributes(attribute.String("location", locKey)))
+			err := updateSummary(ctx, state, updateSummaryOptions{
+				locKey:     locKey,
+				location:   loc,
+				pushUpdate: true,
+			})
+			endSpan(span, err)
+		}),
+	)
+	if err != nil {
+		s.Shutdown()
+		return fmt.Errorf("failed to schedule gocron job for %v: %w", locKey, err)
+	}
+
+	state.locationJobsMutex.Lock()
+	if _, ok := state.locationJobs[locKey]; ok {
+		state.locationJobsMutex.Unlock()
+		s.Shutdown()
+		return fmt.Errorf("location %v is already running", locKey)
+	}
+
+	ctx, cancel := context.WithCancel(state.ctx)
+	j := &locationJob{
+		scheduler:    s,
+		job:          job,
+		updates:      make(chan summaryUpdate),
+		ctx:          ctx,
+		cancel:       cancel,
+		listenerDone: make(chan struct{}),
+		location:     loc,
+	}
+	state.locationJobs[locKey] = j
+	state.locationJobsMutex.Unlock()
+
+	state.subscriptionsMutex.Lock()
+	if _, ok := state.subscriptions[locKey]; !ok {
+		state.subscriptions[locKey] = []*registeredSubscription{}
+	}
+	state.subscriptionsMutex.Unlock()
+
+	// listen for summary updates, and publish updates to all update subscribers via web push
+	go func() {
+		defer close(j.listenerDone)
+		listenForSummaryUpdates(ctx, state, locKey, j.updates)
+	}()
+
+	s.Start()
+
+	slog.Info("update job scheduled", "location", locKey, "hour", loc.deliveryHour, "minute", loc.deliveryMinute)
+
+	return nil
+}
+
+// stopLocation stops the scheduled summary update and the push listener of the location.
+// It waits for the push listener to finish the delivery that it is in the middle of, if any,
+// so that a listener started for the location afterwards does not race with it.
+func stopLocation(state *state, locKey string) {
+	state.locationJobsMutex.Lock()
+	j, ok := state.locationJobs[locKey]
+	delete(state.locationJobs, locKey)
+	state.locationJobsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	j.cancel()
+	err := j.scheduler.Shutdown()
+	if err != nil {
+		slog.Warn("failed to shut down scheduler", "location", locKey, "error", err)
+	}
+	<-j.listenerDone
+
+	slog.Info("update job stopped", "location", locKey)
+}
+
+// stopRemovedLocation stops the job of a location that is no longer supported, and forgets its subscribers, status, and summary.
+// Registrations that are subscribed to the location are kept in the database.
+func stopRemovedLocation(state *state, locKey string) {
+	stopLocation(state, locKey)
+
+	state.subscriptionsMutex.Lock()
+	delete(state.subscriptions, locKey)
+	state.subscriptionsMutex.Unlock()
+
+	state.locationStatusesMutex.Lock()
+	delete(state.locationStatuses, locKey)
+	state.locationStatusesMutex.Unlock()
+
+	state.summaries.Delete(locKey)
+}
+
+// stopAllLocations stops the scheduled jobs and push listeners of every location.
+func stopAllLocations(state *state) {
+	state.locationJobsMutex.Lock()
+	var keys []string
+	for locKey := range state.locationJobs {
+		keys = append(keys, locKey)
+	}
+	state.locationJobsMutex.Unlock()
+
+	for _, locKey := range keys {
+		stopLocation(state, locKey)
+	}
+}
+
+// scheduledJob returns the gocron job that updates the summary of the location.
+func scheduledJob(state *state, locKey string) (gocron.Job, bool) {
+	state.locationJobsMutex.Lock()
+	defer state.locationJobsMutex.Unlock()
+	j, ok := state.locationJobs[locKey]
+	if !ok {
+		return nil, false
+	}
+	return j.job, true
+}
+
+// pushSummaryUpdate hands the update to the push listener of the location.
+// It blocks until the listener receives it, or the location is removed.
+func pushSummaryUpdate(state *state, locKey string, update summaryUpdate) bool {
+	state.locationJobsMutex.Lock()
+	j, ok := state.locationJobs[locKey]
+	state.locationJobsMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case j.updates <- update:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+// reloadLocations loads the locations file again, and starts or stops the jobs of added or removed locations.
+// Locations whose coordinates, time zone, or delivery time have changed are rescheduled, and get a new summary.
+// The current locations are kept if the file is invalid.
+func reloadLocations(state *state) error {
+	configured, err := loadLocations(state.locationsFile)
+	if err != nil {
+		return err
+	}
+
+	// dynamic locations are not added or removed during the reload,
+	// since a location that is added but not started yet would be started by both
+	state.dynamicLocationsMutex.Lock()
+	defer state.dynamicLocationsMutex.Unlock()
+
+	setConfiguredLocations(configured)
+	locs := supportedLocations()
+
+	state.locationJobsMutex.Lock()
+	var removed, changed []string
+	for locKey, j := range state.locationJobs {
+		loc, ok := locs[locKey]
+		if !ok {
+			removed = append(removed, locKey)
+		} else if !loc.sameSchedule(j.location) {
+			changed = append(changed, locKey)
+		}
+	}
+	var added []string
+	for locKey := range locs {
+		if _, ok := state.locationJobs[locKey]; !ok {
+			added = append(added, locKey)
+		}
+	}
+	state.locationJobsMutex.Unlock()
+
+	for _, locKey := range removed {
+		stopRemovedLocation(state, locKey)
+	}
+
+	for _, locKey := range changed {
+		stopLocation(state, locKey)
+		err := startLocation(state, locKey, locs[locKey])
+		if err != nil {
+			slog.Error("failed to reschedule location", "location", locKey, "error", err)
+			continue
+		}
+		go updateSummary(state.ctx, state, updateSummaryOptions{
+			locKey:   locKey,
+			location: locs[locKey],
+		})
+	}
+
+	if len(added) > 0 {
+		for _, locKey := range added {
+			err := startLocation(state, locKey, locs[locKey])
+			if err != nil {
+				slog.Error("failed to schedule location", "location", locKey, "error", err)
+			}
+		}
+
+		// registrations that were made before the location was removed resume
+		err = loadSubscriptions(state, added)
+		if err != nil {
+			slog.Error("failed to load subscriptions of added locations", "error", err)
+		}
+
+		go func() {
+			for _, locKey := range added {
+				fetchInitialSummary(state, locKey, locs[locKey])
+			}
+		}()
+	}
+
+	slog.Info("locations reloaded", "added", added, "removed", removed, "rescheduled", changed)
+
+	return nil
+}
+
+// watchLocationsFile reloads the locations file whenever the process receives SIGHUP.
+func watchLocationsFile(state *state) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-c:
+			slog.Info("reloading locations", "path", state.locationsFile)
+			err := reloadLocations(state)
+			if err != nil {
+				slog.Error("failed to reload locations, keeping the current locations", "error", err)
+			}
+		case <-state.ctx.Done():
+			return
+		}
+	}
+}
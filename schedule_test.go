@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestStartLocationTwice(t *testing.T) {
+	state := newTestState(t)
+	loc, _ := lookupLocation("london")
+
+	err := startLocation(state, "london", loc)
+	if err != nil {
+		t.Fatalf("failed to start location: %v", err)
+	}
+	t.Cleanup(func() { stopAllLocations(state) })
+
+	state.locationJobsMutex.Lock()
+	first := state.locationJobs["london"]
+	state.locationJobsMutex.Unlock()
+
+	if err := startLocation(state, "london", loc); err == nil {
+		t.Error("a running location was started again")
+	}
+
+	state.locationJobsMutex.Lock()
+	running := state.locationJobs["london"]
+	state.locationJobsMutex.Unlock()
+	if running != first {
+		t.Error("the job of a running location was replaced")
+	}
+	if first.ctx.Err() != nil {
+		t.Error("the push listener of a running location was stopped")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultNtfyServer is the ntfy server that is used if a registration does not configure one
+const defaultNtfyServer = "https://ntfy.sh"
+
+// ntfyTopicPattern matches the topic names that ntfy allows
+var ntfyTopicPattern = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+// weatherSeverity is how noteworthy the weather of a summary is, which decides the priority of a push
+type weatherSeverity int
+
+const (
+	severityCalm weatherSeverity = iota
+	severityNormal
+	severityHigh
+	severityExtreme
+)
+
+// ntfyPriorities maps weather severities to ntfy priorities, from 1 (min) to 5 (max)
+var ntfyPriorities = map[weatherSeverity]int{
+	severityCalm:    2,
+	severityNormal:  3,
+	severityHigh:    4,
+	severityExtreme: 5,
+}
+
+// gotifyPriorities maps weather severities to gotify priorities.
+// gotify clients notify silently below 4, and show a popup from 8.
+var gotifyPriorities = map[weatherSeverity]int{
+	severityCalm:    2,
+	severityNormal:  4,
+	severityHigh:    6,
+	severityExtreme: 8,
+}
+
+// ntfyConfig is the channel config of an ntfy registration
+type ntfyConfig struct {
+	// Server is the url of the ntfy server. Empty means defaultNtfyServer.
+	Server string `json:"server,omitempty"`
+	Topic  string `json:"topic"`
+	// Token is an optional access token for topics that require authentication
+	Token string `json:"token,omitempty"`
+}
+
+// gotifyConfig is the channel config of a gotify registration
+type gotifyConfig struct {
+	// Server is the url of the gotify server
+	Server string `json:"server"`
+	// Token is the token of the gotify application that summaries are published to
+	Token string `json:"token"`
+}
+
+// ntfyMessage is the request body of publishing to ntfy as json, see https://docs.ntfy.sh/publish/#publish-as-json
+type ntfyMessage struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title"`
+	Message  string   `json:"message"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags,omitempty"`
+	Click    string   `json:"click,omitempty"`
+}
+
+// gotifyMessage is the request body of POST /message, see https://gotify.net/api-docs
+type gotifyMessage struct {
+	Title    string         `json:"title"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+// ntfyNotifier publishes summaries to the ntfy topics of registrations
+type ntfyNotifier struct {
+	client *http.Client
+	// publicURL is the public url of 7am, which the click url points to. empty if it is not configured.
+	publicURL            string
+	allowPrivateNetworks bool
+}
+
+// gotifyNotifier publishes summaries to the gotify applications of registrations
+type gotifyNotifier struct {
+	client *http.Client
+	// publicURL is the public url of 7am, which the click url points to. empty if it is not configured.
+	publicURL            string
+	allowPrivateNetworks bool
+}
+
+func (nt *ntfyNotifier) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	nc := ntfyConfig{}
+	err := json.Unmarshal(config, &nc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ntfy config: %w", err)
+	}
+
+	nc.Server = strings.TrimSuffix(nc.Server, "/")
+	if nc.Server == defaultNtfyServer {
+		nc.Server = ""
+	}
+	if nc.Server != "" {
+		err = checkOutboundURL("ntfy server", nc.Server, nt.allowPrivateNetworks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ntfyTopicPattern.MatchString(nc.Topic) {
+		return nil, errors.New("ntfy topic must be 1 to 64 letters, digits, dashes or underscores")
+	}
+	if len(nc.Token) > maxWebhookSecretLength {
+		return nil, fmt.Errorf("ntfy token must not be longer than %d bytes", maxWebhookSecretLength)
+	}
+
+	return json.Marshal(&nc)
+}
+
+func (nt *ntfyNotifier) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	config := ntfyConfig{}
+	err := json.Unmarshal(reg.Config, &config)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid ntfy config: %w", err)}
+	}
+
+	p := newWebhookPayload(nt.publicURL, n)
+	msg := ntfyMessage{
+		Topic:    config.Topic,
+		Title:    fmt.Sprintf("%v, %v", p.Location.Name, formatWebhookDate(p.Date)),
+		Message:  formatPushMessage(p),
+		Priority: ntfyPriorities[severityOf(n)],
+		Click:    p.URL,
+	}
+	if n.advisory != "" {
+		// ntfy shows tags that are emoji short codes as emojis
+		msg.Tags = []string{"warning"}
+	}
+
+	body, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if config.Token != "" {
+		header.Set("Authorization", "Bearer "+config.Token)
+	}
+
+	// publishing as json is done by posting to the root of the server
+	status, respBody, err := postJSON(ctx, nt.client, cmp.Or(config.Server, defaultNtfyServer), header, body)
+	return pushServerError(channelNtfy, status, respBody, err)
+}
+
+func (g *gotifyNotifier) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	gc := gotifyConfig{}
+	err := json.Unmarshal(config, &gc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gotify config: %w", err)
+	}
+
+	gc.Server = strings.TrimSuffix(gc.Server, "/")
+	err = checkOutboundURL("gotify server", gc.Server, g.allowPrivateNetworks)
+	if err != nil {
+		return nil, err
+	}
+	if gc.Token == "" {
+		return nil, errors.New("gotify application token is required")
+	}
+	if len(gc.Token) > maxWebhookSecretLength {
+		return nil, fmt.Errorf("gotify token must not be longer than %d bytes", maxWebhookSecretLength)
+	}
+
+	return json.Marshal(&gc)
+}
+
+func (g *gotifyNotifier) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	config := gotifyConfig{}
+	err := json.Unmarshal(reg.Config, &config)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid gotify config: %w", err)}
+	}
+
+	p := newWebhookPayload(g.publicURL, n)
+	msg := gotifyMessage{
+		Title:    fmt.Sprintf("%v, %v", p.Location.Name, formatWebhookDate(p.Date)),
+		Message:  formatPushMessage(p),
+		Priority: gotifyPriorities[severityOf(n)],
+	}
+	if p.URL != "" {
+		// see https://gotify.net/docs/msgextras
+		msg.Extras = map[string]any{
+			"client::notification": map[string]any{
+				"click": map[string]string{"url": p.URL},
+			},
+		}
+	}
+
+	body, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("X-Gotify-Key", config.Token)
+
+	status, respBody, err := postJSON(ctx, g.client, config.Server+"/message", header, body)
+	return pushServerError(channelGotify, status, respBody, err)
+}
+
+// ntfyError is the response body of a failed ntfy request, e.g. {"code": 40101, "http": 401, "error": "unauthorized"}
+type ntfyError struct {
+	Code  int    `json:"code"`
+	HTTP  int    `json:"http"`
+	Error string `json:"error"`
+}
+
+// gotifyError is the response body of a failed gotify request, e.g. {"error": "Unauthorized", "errorCode": 401}
+type gotifyError struct {
+	Error     string `json:"error"`
+	ErrorCode int    `json:"errorCode"`
+}
+
+// pushServerError returns the error of a publish request to the push server of channel that responded with status and body.
+func pushServerError(channel string, status int, body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if status >= 200 && status < 300 {
+		return nil
+	}
+	return &deliveryError{
+		statusCode: status,
+		// an unknown topic or application, or an invalid token, will not fix itself
+		permanent: status >= 400 && status < 500 && status != http.StatusTooManyRequests,
+		// a 404 can also come from a proxy in front of the server, or from a server that is not ntfy or gotify at all,
+		// so it only means that the registration is gone if the push server itself says so
+		gone: status == http.StatusUnauthorized || status == http.StatusForbidden ||
+			(status == http.StatusNotFound && isPushServerError(channel, status, body)),
+		err: fmt.Errorf("%v server rejected the message", channel),
+	}
+}
+
+// isPushServerError reports whether body is an error response of the push server of channel for status.
+func isPushServerError(channel string, status int, body []byte) bool {
+	switch channel {
+	case channelNtfy:
+		e := ntfyError{}
+		return json.Unmarshal(body, &e) == nil && e.HTTP == status && e.Code/100 == status && e.Error != ""
+	case channelGotify:
+		e := gotifyError{}
+		return json.Unmarshal(body, &e) == nil && e.ErrorCode == status && e.Error != ""
+	}
+	return false
+}
+
+// formatPushMessage formats the body of a push notification, which has the summary, advisory, and temperature range.
+func formatPushMessage(p *webhookPayload) string {
+	var sb strings.Builder
+	sb.WriteString(p.Summary)
+	if p.Advisory != "" {
+		fmt.Fprintf(&sb, "\n\n⚠️ %v", p.Advisory)
+	}
+	if p.Forecast != nil {
+		fmt.Fprintf(&sb, "\n\n🌡️ %v", formatTemperatureRange(p.Forecast))
+	}
+	return sb.String()
+}
+
+// severityOf rates the weather of a notification from its forecast and advisory.
+func severityOf(n *notification) weatherSeverity {
+	severity := severityNormal
+	if n.advisory != "" {
+		severity = severityHigh
+	}
+
+	f := n.forecast
+	if f == nil {
+		return severity
+	}
+
+	switch {
+	case f.maxTemp >= 35 || f.minTemp <= -15 || f.maxPrecipitation >= 10:
+		return severityExtreme
+	case f.maxTemp >= 30 || f.minTemp <= -5 || f.maxPrecipitation >= 4 || f.totalPrecipitation >= 20:
+		return severityHigh
+	case severity == severityHigh:
+		return severity
+	case f.totalPrecipitation < 1 && f.maxTemp < 25 && f.minTemp > 0:
+		return severityCalm
+	default:
+		return severityNormal
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSeverityOf(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		advisory string
+		forecast *forecastStats
+		want     weatherSeverity
+	}{
+		{"no forecast", "", nil, severityNormal},
+		{"advisory without forecast", "High pollen", nil, severityHigh},
+		{"mild and dry", "", &forecastStats{minTemp: 8, maxTemp: 18}, severityCalm},
+		{"light rain", "", &forecastStats{minTemp: 8, maxTemp: 18, totalPrecipitation: 3, maxPrecipitation: 1}, severityNormal},
+		{"warm", "", &forecastStats{minTemp: 15, maxTemp: 26}, severityNormal},
+		{"frost", "", &forecastStats{minTemp: -2, maxTemp: 4}, severityNormal},
+		{"mild with advisory", "High pollen", &forecastStats{minTemp: 8, maxTemp: 18}, severityHigh},
+		{"hot", "", &forecastStats{minTemp: 20, maxTemp: 31}, severityHigh},
+		{"cold", "", &forecastStats{minTemp: -8, maxTemp: -1}, severityHigh},
+		{"heavy showers", "", &forecastStats{minTemp: 8, maxTemp: 18, totalPrecipitation: 8, maxPrecipitation: 5}, severityHigh},
+		{"rain all day", "", &forecastStats{minTemp: 8, maxTemp: 18, totalPrecipitation: 24, maxPrecipitation: 3}, severityHigh},
+		{"heat wave", "", &forecastStats{minTemp: 24, maxTemp: 38}, severityExtreme},
+		{"deep frost", "", &forecastStats{minTemp: -20, maxTemp: -12}, severityExtreme},
+		{"cloudburst", "Heavy rain", &forecastStats{minTemp: 15, maxTemp: 22, totalPrecipitation: 30, maxPrecipitation: 12}, severityExtreme},
+	} {
+		if got := severityOf(&notification{advisory: tc.advisory, forecast: tc.forecast}); got != tc.want {
+			t.Errorf("%v: severity is %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// publishedMessage is a request received by a fake push server
+type publishedMessage struct {
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+// newFakePushServer starts a push server that records the messages published to it, and responds with status and body.
+func newFakePushServer(t *testing.T, status int, body string) (*httptest.Server, chan publishedMessage) {
+	t.Helper()
+	messages := make(chan publishedMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		b, _ := io.ReadAll(request.Body)
+		msg := publishedMessage{path: request.URL.Path, header: request.Header}
+		json.Unmarshal(b, &msg.body)
+		messages <- msg
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		io.WriteString(writer, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, messages
+}
+
+func testPushNotification(t *testing.T) *notification {
+	t.Helper()
+	loc, _ := lookupLocation("london")
+	return &notification{
+		locKey:   "london",
+		location: loc,
+		summary:  "It is hot in London today.",
+		advisory: "High UV index",
+		forecast: &forecastStats{minTemp: 20, maxTemp: 36},
+	}
+}
+
+func TestNtfyNotify(t *testing.T) {
+	newTestState(t)
+	server, messages := newFakePushServer(t, http.StatusOK, `{"id": "abc"}`)
+	n := testPushNotification(t)
+
+	for _, publicURL := range []string{"https://7am.example.com", ""} {
+		nt := &ntfyNotifier{client: server.Client(), publicURL: publicURL}
+		config, _ := json.Marshal(ntfyConfig{Server: server.URL, Topic: "my-7am", Token: "tk_secret"})
+		err := nt.Notify(context.Background(), &registeredSubscription{Channel: channelNtfy, Config: config}, n)
+		if err != nil {
+			t.Fatalf("publishing failed: %v", err)
+		}
+
+		msg := <-messages
+		if msg.path != "/" || msg.header.Get("Authorization") != "Bearer tk_secret" {
+			t.Errorf("published to %v with authorization %q", msg.path, msg.header.Get("Authorization"))
+		}
+		if msg.body["topic"] != "my-7am" || msg.body["priority"] != float64(ntfyPriorities[severityExtreme]) {
+			t.Errorf("unexpected topic or priority: %v", msg.body)
+		}
+		if title, _ := msg.body["title"].(string); !strings.HasPrefix(title, "London, ") {
+			t.Errorf("title is %q", title)
+		}
+		if message, _ := msg.body["message"].(string); !strings.HasPrefix(message, n.summary) || !strings.Contains(message, "High UV index") {
+			t.Errorf("message is %q", message)
+		}
+		if tags, _ := msg.body["tags"].([]any); len(tags) != 1 || tags[0] != "warning" {
+			t.Errorf("tags are %v", msg.body["tags"])
+		}
+
+		click, hasClick := msg.body["click"]
+		if publicURL == "" && hasClick {
+			t.Errorf("click url %v is set without PUBLIC_URL", click)
+		}
+		if publicURL != "" && click != publicURL+"/london" {
+			t.Errorf("click url is %v", click)
+		}
+	}
+}
+
+func TestGotifyNotify(t *testing.T) {
+	newTestState(t)
+	server, messages := newFakePushServer(t, http.StatusOK, `{"id": 1}`)
+	n := testPushNotification(t)
+
+	for _, publicURL := range []string{"https://7am.example.com", ""} {
+		g := &gotifyNotifier{client: server.Client(), publicURL: publicURL}
+		config, _ := json.Marshal(gotifyConfig{Server: server.URL, Token: "app-token"})
+		err := g.Notify(context.Background(), &registeredSubscription{Channel: channelGotify, Config: config}, n)
+		if err != nil {
+			t.Fatalf("publishing failed: %v", err)
+		}
+
+		msg := <-messages
+		if msg.path != "/message" || msg.header.Get("X-Gotify-Key") != "app-token" {
+			t.Errorf("published to %v with key %q", msg.path, msg.header.Get("X-Gotify-Key"))
+		}
+		if msg.body["priority"] != float64(gotifyPriorities[severityExtreme]) {
+			t.Errorf("priority is %v", msg.body["priority"])
+		}
+
+		extras, hasExtras := msg.body["extras"].(map[string]any)
+		if publicURL == "" {
+			if hasExtras {
+				t.Errorf("extras %v are set without PUBLIC_URL", extras)
+			}
+			continue
+		}
+		b, _ := json.Marshal(extras)
+		if want := `{"client::notification":{"click":{"url":"https://7am.example.com/london"}}}`; string(b) != want {
+			t.Errorf("extras are %s, expected %s", b, want)
+		}
+	}
+}
+
+func TestPushServerErrors(t *testing.T) {
+	newTestState(t)
+	n := testPushNotification(t)
+
+	for _, tc := range []struct {
+		channel   string
+		status    int
+		body      string
+		permanent bool
+		gone      bool
+	}{
+		{channelNtfy, http.StatusUnauthorized, `{"code": 40101, "http": 401, "error": "unauthorized"}`, true, true},
+		{channelNtfy, http.StatusForbidden, `{"code": 40301, "http": 403, "error": "forbidden"}`, true, true},
+		{channelNtfy, http.StatusNotFound, `{"code": 40401, "http": 404, "error": "page not found"}`, true, true},
+		{channelNtfy, http.StatusNotFound, `<html><body>404 Not Found</body></html>`, true, false},
+		{channelNtfy, http.StatusNotFound, `{"error": "Not Found", "errorCode": 404}`, true, false},
+		{channelNtfy, http.StatusTooManyRequests, `{"code": 42901, "http": 429, "error": "limit reached"}`, false, false},
+		{channelNtfy, http.StatusBadGateway, ``, false, false},
+		{channelGotify, http.StatusUnauthorized, `{"error": "Unauthorized", "errorCode": 401, "errorDescription": "you need to provide a valid access token"}`, true, true},
+		{channelGotify, http.StatusNotFound, `{"error": "Not Found", "errorCode": 404, "errorDescription": "application does not exist"}`, true, true},
+		{channelGotify, http.StatusNotFound, `404 page not found`, true, false},
+		{channelGotify, http.StatusBadRequest, `{"error": "Bad Request", "errorCode": 400}`, true, false},
+	} {
+		server, messages := newFakePushServer(t, tc.status, tc.body)
+
+		var err error
+		switch tc.channel {
+		case channelNtfy:
+			config, _ := json.Marshal(ntfyConfig{Server: server.URL, Topic: "my-7am"})
+			err = (&ntfyNotifier{client: server.Client()}).Notify(context.Background(), &registeredSubscription{Channel: tc.channel, Config: config}, n)
+		case channelGotify:
+			config, _ := json.Marshal(gotifyConfig{Server: server.URL, Token: "app-token"})
+			err = (&gotifyNotifier{client: server.Client()}).Notify(context.Background(), &registeredSubscription{Channel: tc.channel, Config: config}, n)
+		}
+		<-messages
+
+		deliveryErr := &deliveryError{}
+		if !errors.As(err, &deliveryErr) {
+			t.Errorf("%v %v: expected a delivery error, got %v", tc.channel, tc.status, err)
+			continue
+		}
+		if deliveryErr.statusCode != tc.status || deliveryErr.permanent != tc.permanent || deliveryErr.gone != tc.gone {
+			t.Errorf("%v %v %v: got status %v, permanent %v and gone %v, expected permanent %v and gone %v",
+				tc.channel, tc.status, tc.body, deliveryErr.statusCode, deliveryErr.permanent, deliveryErr.gone, tc.permanent, tc.gone)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/google/uuid"
+)
+
+// pushServiceHosts are the hosts of the push services of major browsers.
+// An entry starting with a dot also matches any subdomain.
+var pushServiceHosts = []string{
+	// chrome, edge, and other chromium based browsers
+	"fcm.googleapis.com",
+	"android.googleapis.com",
+	// firefox
+	"updates.push.services.mozilla.com",
+	// safari
+	".push.apple.com",
+	// legacy edge
+	".notify.windows.com",
+}
+
+// errInvalidRegistrationToken is returned when a request to manage a registration
+// does not carry the management token of the registration.
+var errInvalidRegistrationToken = errors.New("invalid registration token")
+
+// errInvalidSubscription wraps the error of a registration whose channel config or coordinates failed validation.
+var errInvalidSubscription = errors.New("invalid subscription")
+
+// registrationResponse is the response body of the registration endpoints.
+// Token is only included when a new management token is issued.
+type registrationResponse struct {
+	*registeredSubscription
+	Token string `json:"token,omitempty"`
+}
+
+// unknownLocationsError is returned when a registration refers to locations that are not in supportedLocations.
+type unknownLocationsError struct {
+	locations []string
+}
+
+func (e *unknownLocationsError) Error() string {
+	return fmt.Sprintf("unknown locations: %v", strings.Join(e.locations, ", "))
+}
+
+// unknownLocationsDetails is the details of an unknown_location error.
+type unknownLocationsDetails struct {
+	UnknownLocations []string `json:"unknownLocations"`
+	ValidLocations   []string `json:"validLocations"`
+}
+
+// checkLocations returns an *unknownLocationsError if any of locs is not a supported location.
+func checkLocations(locs []string) error {
+	var unknown []string
+	for _, l := range locs {
+		if _, ok := lookupLocation(l); !ok {
+			unknown = append(unknown, l)
+		}
+	}
+	if len(unknown) > 0 {
+		return &unknownLocationsError{unknown}
+	}
+	return nil
+}
+
+// validateUpdateSubscription checks the body of a registration request, and sets the validated channel config of update.
+// A web push subscription sent in place of a channel config is the config of the webpush channel.
+func validateUpdateSubscription(state *state, update *updateSubscription) error {
+	if update.Subscription != nil {
+		if update.Channel != "" && update.Channel != channelWebPush {
+			return fmt.Errorf("%w: subscription is only accepted for the %v channel", errInvalidSubscription, channelWebPush)
+		}
+		j, err := json.Marshal(update.Subscription)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidSubscription, err)
+		}
+		update.Channel = channelWebPush
+		update.Config = j
+	}
+
+	if update.Channel != "" {
+		notifier, ok := state.notifiers[update.Channel]
+		if !ok {
+			return fmt.Errorf("%w: unknown channel %v", errInvalidSubscription, update.Channel)
+		}
+		if update.Config != nil {
+			config, err := notifier.ValidateConfig(update.Config)
+			if err != nil {
+				return fmt.Errorf("%w: %w", errInvalidSubscription, err)
+			}
+			update.config = config
+		}
+	} else if update.Config != nil {
+		return fmt.Errorf("%w: channel is required with config", errInvalidSubscription)
+	}
+
+	if update.Coordinates != nil {
+		err := update.Coordinates.validate()
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidSubscription, err)
+		}
+	}
+	return checkLocations(update.Locations)
+}
+
+// validateSubscription checks that sub has an https endpoint on a known push service,
+// and well-formed encryption keys.
+func validateSubscription(sub *webpush.Subscription) error {
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid subscription endpoint: %w", err)
+	}
+	if u.Scheme != "https" {
+		return errors.New("subscription endpoint must be an https url")
+	}
+	if !isPushServiceHost(u.Hostname()) {
+		return fmt.Errorf("subscription endpoint %v is not on a known push service", u.Hostname())
+	}
+
+	// p256dh is an uncompressed P-256 public key, see RFC 8291 section 3.1
+	p256dh, err := decodeSubscriptionKey(sub.Keys.P256dh)
+	if err != nil || len(p256dh) != 65 || p256dh[0] != 0x04 {
+		return errors.New("invalid p256dh key")
+	}
+
+	// auth is a 16 byte secret, see RFC 8291 section 3.2
+	auth, err := decodeSubscriptionKey(sub.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return errors.New("invalid auth key")
+	}
+
+	return nil
+}
+
+func isPushServiceHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range pushServiceHosts {
+		if strings.HasPrefix(h, ".") {
+			if strings.HasSuffix(host, h) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSubscriptionKey decodes a key of a push subscription.
+// Browsers send base64url without padding, but padded and standard base64 are accepted as well.
+func decodeSubscriptionKey(key string) ([]byte, error) {
+	if strings.ContainsAny(key, "+/") {
+		return base64.StdEncoding.DecodeString(padBase64(key))
+	}
+	return base64.URLEncoding.DecodeString(padBase64(key))
+}
+
+func padBase64(s string) string {
+	s = strings.TrimRight(s, "=")
+	if n := len(s) % 4; n != 0 {
+		s += strings.Repeat("=", 4-n)
+	}
+	return s
+}
+
+// newRegistrationToken generates a management token for a registration.
+// Only the returned hash should be stored.
+func newRegistrationToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to generate registration token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRegistrationToken(token), nil
+}
+
+func hashRegistrationToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// sqlExecer is implemented by *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// insertChannelRegistration stores a registration that is managed by its channel instead of the registration api,
+// such as an email registration that is managed through signed links.
+func insertChannelRegistration(db sqlExecer, id string, channel string, locations string, config any) error {
+	j, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	// the management token is thrown away, but a hash is still stored,
+	// so that the registration can not be claimed like registrations without a token.
+	_, tokenHash, err := newRegistrationToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO subscriptions (id, channel, locations, subscription_json, token_hash) VALUES (?, ?, ?, ?, ?)",
+		id, channel, locations, string(j), tokenHash,
+	)
+	return err
+}
+
+// deleteRegistrationRequest is the optional request body of DELETE /registrations/{id}
+type deleteRegistrationRequest struct {
+	// Subscription proves that the client holds the web push subscription of a registration without a token
+	Subscription *webpush.Subscription `json:"subscription"`
+}
+
+// authorizeRegistration checks that the request carries the management token of the given registration as a bearer token.
+// Registrations created before management tokens were introduced have no token. For those, legacy is true,
+// and the request is only allowed if proof is the web push subscription of the registration,
+// which only the browser that registered it knows.
+// sql.ErrNoRows is returned if the registration does not exist.
+func authorizeRegistration(state *state, regID uuid.UUID, request *http.Request, proof *webpush.Subscription) (legacy bool, err error) {
+	var tokenHash sql.NullString
+	var config []byte
+	err = state.db.QueryRow("SELECT token_hash, subscription_json FROM subscriptions WHERE id = ?", regID).Scan(&tokenHash, &config)
+	if err != nil {
+		return false, err
+	}
+
+	if !tokenHash.Valid {
+		if proof == nil || !isSameWebPushSubscription(config, proof) {
+			return true, errInvalidRegistrationToken
+		}
+		return true, nil
+	}
+
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(hashRegistrationToken(token)), []byte(tokenHash.String)) != 1 {
+		return false, errInvalidRegistrationToken
+	}
+
+	return false, nil
+}
+
+// isSameWebPushSubscription reports whether sub has the endpoint and keys of the stored web push subscription.
+func isSameWebPushSubscription(config []byte, sub *webpush.Subscription) bool {
+	stored := webpush.Subscription{}
+	if json.Unmarshal(config, &stored) != nil || stored.Endpoint == "" || stored.Endpoint != sub.Endpoint {
+		return false
+	}
+	return isSameSubscriptionKey(stored.Keys.P256dh, sub.Keys.P256dh) && isSameSubscriptionKey(stored.Keys.Auth, sub.Keys.Auth)
+}
+
+// isSameSubscriptionKey compares two keys of push subscriptions, which may be encoded differently.
+func isSameSubscriptionKey(a string, b string) bool {
+	ka, err := decodeSubscriptionKey(a)
+	if err != nil || len(ka) == 0 {
+		return false
+	}
+	kb, err := decodeSubscriptionKey(b)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(ka, kb) == 1
+}
+
+// writeRegistrationError responds to a registration request that failed with err.
+func writeRegistrationError(writer http.ResponseWriter, err error) {
+	var unknownErr *unknownLocationsError
+	switch {
+	case errors.As(err, &unknownErr):
+		writeError(writer, http.StatusBadRequest, errCodeUnknownLocation, err.Error(), unknownLocationsDetails{
+			UnknownLocations: unknownErr.locations,
+			ValidLocations:   supportedLocationKeys(),
+		})
+	case errors.Is(err, errInvalidSubscription):
+		writeError(writer, http.StatusBadRequest, errCodeInvalidSubscription, err.Error(), nil)
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(writer, http.StatusNotFound, errCodeNotFound, "registration not found", nil)
+	case errors.Is(err, errInvalidRegistrationToken):
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(writer, http.StatusUnauthorized, errCodeUnauthorized, "missing or invalid registration token", nil)
+	default:
+		writeInternalError(writer)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultTelegramAPIURL is the url of the telegram bot api
+	defaultTelegramAPIURL = "https://api.telegram.org"
+	// telegramPollTimeout is how long a getUpdates request waits for new messages
+	telegramPollTimeout = 50 * time.Second
+	// telegramPollRetryDelay is the delay before polling again after getUpdates failed
+	telegramPollRetryDelay = 10 * time.Second
+	// telegramRequestTimeout is the timeout of bot api requests other than getUpdates
+	telegramRequestTimeout = 10 * time.Second
+	// maxTelegramListedLocations is the number of locations that the reply to an unknown location lists.
+	// a message can be at most 4096 characters long.
+	maxTelegramListedLocations = 20
+	// maxTelegramEchoLength is the number of characters of a command argument that a reply repeats
+	maxTelegramEchoLength = 64
+)
+
+// telegramBot receives subscribe and unsubscribe commands over long polling, and sends summaries to the subscribed chats.
+// See https://core.telegram.org/bots/api
+type telegramBot struct {
+	state *state
+	// apiURL is the url of the bot api, which can be changed to test against a local fake server
+	apiURL string
+	token  string
+	// pollClient is used for getUpdates. it does not trace requests, since a request is sent every telegramPollTimeout.
+	pollClient *http.Client
+}
+
+// telegramConfig is the channel config of a telegram registration
+type telegramConfig struct {
+	ChatID int64 `json:"chatId"`
+}
+
+// telegramResponse is the response body of every bot api method
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+// telegramAPIError is returned when the bot api responds with ok set to false
+type telegramAPIError struct {
+	code        int
+	description string
+}
+
+func (e *telegramAPIError) Error() string {
+	return fmt.Sprintf("telegram bot api error %d: %v", e.code, e.description)
+}
+
+// newTelegramBotFromEnv configures a telegram bot from TELEGRAM_BOT_TOKEN and TELEGRAM_API_URL.
+// It returns nil if TELEGRAM_BOT_TOKEN is not set.
+func newTelegramBotFromEnv(state *state) (*telegramBot, error) {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		return nil, nil
+	}
+
+	apiURL := strings.TrimSuffix(os.Getenv("TELEGRAM_API_URL"), "/")
+	if apiURL == "" {
+		apiURL = defaultTelegramAPIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid TELEGRAM_API_URL %v", apiURL)
+	}
+
+	return &telegramBot{
+		state:      state,
+		apiURL:     apiURL,
+		token:      token,
+		pollClient: &http.Client{},
+	}, nil
+}
+
+// ValidateConfig rejects telegram registrations made through the registration api,
+// since chats subscribe by sending /subscribe to the bot.
+func (b *telegramBot) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	return nil, errors.New("telegram registrations are created by sending /subscribe to the bot")
+}
+
+// Notify sends the summary of a location to the chat of a telegram registration.
+func (b *telegramBot) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	config := telegramConfig{}
+	err := json.Unmarshal(reg.Config, &config)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid telegram config: %w", err)}
+	}
+
+	err = b.sendMessage(ctx, config.ChatID, formatTelegramSummary(newWebhookPayload(b.state.publicURL, n)))
+	var apiErr *telegramAPIError
+	if errors.As(err, &apiErr) {
+		return &deliveryError{
+			statusCode: apiErr.code,
+			// 403 means that the bot was blocked or removed from the chat, and 400 that the chat does not exist,
+			// or that the message was rejected
+			permanent: apiErr.code == http.StatusForbidden || apiErr.code == http.StatusBadRequest,
+			gone:      apiErr.code == http.StatusForbidden || (apiErr.code == http.StatusBadRequest && strings.Contains(apiErr.description, "chat not found")),
+			err:       err,
+		}
+	}
+	return err
+}
+
+// formatTelegramSummary formats a summary as a message with html formatting.
+func formatTelegramSummary(p *webhookPayload) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<b>%v, %v</b>\n\n%v", html.EscapeString(p.Location.Name), formatWebhookDate(p.Date), html.EscapeString(p.Summary))
+	if p.Advisory != "" {
+		fmt.Fprintf(&sb, "\n\n⚠️ %v", html.EscapeString(p.Advisory))
+	}
+	if p.Forecast != nil {
+		fmt.Fprintf(&sb, "\n\n🌡️ %v", formatTemperatureRange(p.Forecast))
+	}
+	if p.URL != "" {
+		fmt.Fprintf(&sb, "\n\n<a href=\"%v\">Open in 7am</a>", html.EscapeString(p.URL))
+	}
+	return sb.String()
+}
+
+// poll receives updates with long polling and handles the commands in them, until ctx is cancelled.
+func (b *telegramBot) poll(ctx context.Context) {
+	slog.Info("telegram bot started")
+
+	var offset int64
+	for {
+		updates, err := b.getUpdates(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("failed to get telegram updates", "error", err)
+			select {
+			case <-time.After(telegramPollRetryDelay):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for _, u := range updates {
+			// updates are confirmed by requesting the updates after them
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				b.handleMessage(ctx, u.Message)
+			}
+		}
+	}
+}
+
+func (b *telegramBot) getUpdates(ctx context.Context, offset int64) ([]telegramUpdate, error) {
+	ctx, cancel := context.WithTimeout(ctx, telegramPollTimeout+telegramRequestTimeout)
+	defer cancel()
+
+	var updates []telegramUpdate
+	err := b.call(ctx, b.pollClient, "getUpdates", map[string]any{
+		"offset":          offset,
+		"timeout":         int(telegramPollTimeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	return updates, err
+}
+
+func (b *telegramBot) sendMessage(ctx context.Context, chatID int64, text string) error {
+	ctx, cancel := context.WithTimeout(ctx, telegramRequestTimeout)
+	defer cancel()
+
+	return b.call(ctx, httpClient, "sendMessage", map[string]any{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}, nil)
+}
+
+// call calls a method of the bot api, and decodes its result into result if it is not nil.
+func (b *telegramBot) call(ctx context.Context, client *http.Client, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiURL+"/bot"+b.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the url of the request contains the token, so it is left out of the error
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %v request failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	res := telegramResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("invalid telegram %v response with status %d: %w", method, resp.StatusCode, err)
+	}
+	if !res.OK {
+		return &telegramAPIError{code: res.ErrorCode, description: res.Description}
+	}
+
+	if result != nil {
+		return json.Unmarshal(res.Result, result)
+	}
+	return nil
+}
+
+// handleMessage responds to a command sent to the bot.
+func (b *telegramBot) handleMessage(ctx context.Context, msg *telegramMessage) {
+	command, arg, _ := strings.Cut(strings.TrimSpace(msg.Text), " ")
+	// in groups, commands can be addressed to a bot with /command@botname
+	command, _, _ = strings.Cut(command, "@")
+	arg = strings.TrimSpace(arg)
+
+	var reply string
+	var err error
+	switch command {
+	case "/subscribe":
+		reply, err = b.subscribe(msg.Chat.ID, arg)
+	case "/unsubscribe":
+		reply, err = b.unsubscribe(msg.Chat.ID, arg)
+	case "/start", "/help":
+		reply = telegramHelp
+	default:
+		// other messages, such as messages between members of a group, are ignored
+		return
+	}
+	if err != nil {
+		slog.Error("failed to handle telegram command", "command", command, "chat", msg.Chat.ID, "error", err)
+		reply = "Sorry, something went wrong. Please try again later."
+	}
+
+	err = b.sendMessage(ctx, msg.Chat.ID, reply)
+	if err != nil {
+		slog.Warn("failed to reply to telegram command", "command", command, "chat", msg.Chat.ID, "error", err)
+	}
+}
+
+const telegramHelp = "Send <code>/subscribe london</code> to receive the weather summary of a location every morning.\n" +
+	"Send <code>/unsubscribe london</code> to stop receiving a single location, or <code>/unsubscribe</code> to stop receiving all of them."
+
+// subscribe subscribes a chat to the location with the given key or name, and returns the reply to the command.
+func (b *telegramBot) subscribe(chatID int64, arg string) (string, error) {
+	if arg == "" {
+		return telegramHelp, nil
+	}
+
+	locKey, loc, ok := findLocation(arg)
+	if !ok {
+		return b.unknownLocationReply(arg), nil
+	}
+
+	b.state.dbMutex.Lock()
+	defer b.state.dbMutex.Unlock()
+
+	reg, err := findTelegramRegistration(b.state, chatID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		id, err := uuid.NewV7()
+		if err != nil {
+			return "", err
+		}
+		reg = &registeredSubscription{ID: id, Channel: channelTelegram, Locations: []string{locKey}}
+		reg.Config, err = json.Marshal(telegramConfig{ChatID: chatID})
+		if err != nil {
+			return "", err
+		}
+		err = insertChannelRegistration(b.state.db, id.String(), channelTelegram, locKey, telegramConfig{ChatID: chatID})
+		if err != nil {
+			return "", err
+		}
+
+	case err == nil:
+		if !slices.Contains(reg.Locations, locKey) {
+			reg.Locations = append(reg.Locations, locKey)
+			_, err = b.state.db.Exec("UPDATE subscriptions SET locations = ? WHERE id = ?", strings.Join(reg.Locations, ","), reg.ID)
+			if err != nil {
+				return "", err
+			}
+		}
+
+	default:
+		return "", err
+	}
+
+	indexRegistration(b.state, reg)
+
+	slog.Info("telegram chat subscribed", "id", reg.ID, "location", locKey)
+
+	return fmt.Sprintf("Subscribed to %v. You will receive its weather summary every day at %v local time.",
+		html.EscapeString(loc.displayName), loc.deliveryTime()), nil
+}
+
+// unknownLocationReply returns the reply to a command with a location that does not exist.
+// Only the first maxTelegramListedLocations locations are listed, so that the reply fits in a message.
+func (b *telegramBot) unknownLocationReply(arg string) string {
+	keys := supportedLocationKeys()
+	listed := keys[:min(len(keys), maxTelegramListedLocations)]
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "I don't know %v. The locations are: %v", html.EscapeString(truncateTelegramEcho(arg)), html.EscapeString(strings.Join(listed, ", ")))
+	if more := len(keys) - len(listed); more > 0 {
+		fmt.Fprintf(&sb, ", and %d more", more)
+		if b.state.publicURL != "" {
+			fmt.Fprintf(&sb, `, see <a href="%v">the list of all locations</a>`, html.EscapeString(b.state.publicURL+"/api/locations"))
+		}
+	}
+	sb.WriteString(".")
+	return sb.String()
+}
+
+// truncateTelegramEcho shortens a command argument that is repeated in a reply to maxTelegramEchoLength characters.
+func truncateTelegramEcho(s string) string {
+	if utf8.RuneCountInString(s) <= maxTelegramEchoLength {
+		return s
+	}
+	return string([]rune(s)[:maxTelegramEchoLength-1]) + "…"
+}
+
+// unsubscribe unsubscribes a chat from the location with the given key or name, or from every location if arg is empty,
+// and returns the reply to the command.
+func (b *telegramBot) unsubscribe(chatID int64, arg string) (string, error) {
+	b.state.dbMutex.Lock()
+	defer b.state.dbMutex.Unlock()
+
+	reg, err := findTelegramRegistration(b.state, chatID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "This chat is not subscribed to any location.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if arg != "" {
+		locKey, loc, ok := findLocation(arg)
+		if !ok || !slices.Contains(reg.Locations, locKey) {
+			return fmt.Sprintf("This chat is not subscribed to %v.", html.EscapeString(truncateTelegramEcho(arg))), nil
+		}
+
+		reg.Locations = slices.DeleteFunc(reg.Locations, func(l string) bool { return l == locKey })
+		if len(reg.Locations) > 0 {
+			_, err = b.state.db.Exec("UPDATE subscriptions SET locations = ? WHERE id = ?", strings.Join(reg.Locations, ","), reg.ID)
+			if err != nil {
+				return "", err
+			}
+			indexRegistration(b.state, reg)
+			slog.Info("telegram chat unsubscribed from location", "id", reg.ID, "location", locKey)
+			return fmt.Sprintf("Unsubscribed from %v.", html.EscapeString(loc.displayName)), nil
+		}
+	}
+
+	err = deleteSubscription(b.state, reg.ID)
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("telegram chat unsubscribed", "id", reg.ID)
+
+	return "Unsubscribed. You will no longer receive weather summaries.", nil
+}
+
+// findTelegramRegistration returns the registration of a chat.
+// sql.ErrNoRows is returned if the chat is not subscribed.
+func findTelegramRegistration(state *state, chatID int64) (*registeredSubscription, error) {
+	var id, locations, config string
+	err := state.db.QueryRow(
+		"SELECT id, locations, subscription_json FROM subscriptions WHERE channel = ? AND json_extract(subscription_json, '$.chatId') = ?",
+		channelTelegram, chatID,
+	).Scan(&id, &locations, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registeredSubscription{
+		ID:        uuid.MustParse(id),
+		Channel:   channelTelegram,
+		Config:    json.RawMessage(config),
+		Locations: strings.Split(locations, ","),
+	}, nil
+}
+
+// findLocation looks up a supported location by its key or display name, ignoring case.
+func findLocation(s string) (string, *location, bool) {
+	if loc, ok := lookupLocation(strings.ToLower(s)); ok {
+		return strings.ToLower(s), loc, true
+	}
+	for locKey, loc := range supportedLocations() {
+		if strings.EqualFold(loc.displayName, s) {
+			return locKey, loc, true
+		}
+	}
+	return "", nil, false
+}
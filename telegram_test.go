@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const testTelegramToken = "123456:secret-token"
+
+// telegramSentMessage is a message sent with the sendMessage method of the fake bot api
+type telegramSentMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// newFakeTelegramAPI starts a fake bot api that responds to every method call with respond,
+// and returns a bot that calls it.
+func newFakeTelegramAPI(t *testing.T, state *state, respond func(request *http.Request, method string, params []byte) telegramResponse) *telegramBot {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		method, ok := strings.CutPrefix(request.URL.Path, "/bot"+testTelegramToken+"/")
+		res := telegramResponse{OK: false, ErrorCode: http.StatusNotFound, Description: "Not Found"}
+		if ok {
+			params, _ := io.ReadAll(request.Body)
+			res = respond(request, method, params)
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		if !res.OK {
+			writer.WriteHeader(res.ErrorCode)
+		}
+		json.NewEncoder(writer).Encode(res)
+	}))
+	t.Cleanup(server.Close)
+
+	return &telegramBot{
+		state:      state,
+		apiURL:     server.URL,
+		token:      testTelegramToken,
+		pollClient: server.Client(),
+	}
+}
+
+func telegramResult(t *testing.T, result any) telegramResponse {
+	t.Helper()
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return telegramResponse{OK: true, Result: j}
+}
+
+func TestTelegramCall(t *testing.T) {
+	state := newTestState(t)
+	b := newFakeTelegramAPI(t, state, func(request *http.Request, method string, params []byte) telegramResponse {
+		switch method {
+		case "getMe":
+			return telegramResult(t, map[string]any{"id": 123456, "username": "sevenam_bot"})
+		case "echo":
+			return telegramResponse{OK: true, Result: params}
+		case "sendMessage":
+			return telegramResponse{OK: false, ErrorCode: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"}
+		}
+		return telegramResponse{OK: false, ErrorCode: http.StatusNotFound, Description: "Not Found"}
+	})
+	ctx := context.Background()
+
+	me := struct {
+		Username string `json:"username"`
+	}{}
+	err := b.call(ctx, httpClient, "getMe", map[string]any{}, &me)
+	if err != nil || me.Username != "sevenam_bot" {
+		t.Errorf("getMe returned %+v, %v", me, err)
+	}
+
+	echo := map[string]any{}
+	err = b.call(ctx, httpClient, "echo", map[string]any{"chat_id": 42}, &echo)
+	if err != nil || echo["chat_id"] != float64(42) {
+		t.Errorf("params were not sent as json, got %v, %v", echo, err)
+	}
+
+	err = b.call(ctx, httpClient, "sendMessage", map[string]any{"chat_id": 42, "text": "hi"}, nil)
+	apiErr := &telegramAPIError{}
+	if !errors.As(err, &apiErr) || apiErr.code != http.StatusForbidden || !strings.Contains(apiErr.description, "blocked") {
+		t.Errorf("expected a telegram api error with status 403, got %v", err)
+	}
+
+	// the url of a request contains the token, which must not end up in logs
+	unreachable := &telegramBot{state: state, apiURL: "http://127.0.0.1:1", token: testTelegramToken}
+	err = unreachable.call(ctx, httpClient, "getMe", map[string]any{}, nil)
+	if err == nil {
+		t.Fatal("calling an unreachable bot api did not fail")
+	}
+	if strings.Contains(err.Error(), testTelegramToken) {
+		t.Errorf("error contains the bot token: %v", err)
+	}
+}
+
+func TestTelegramNotify(t *testing.T) {
+	state := newTestState(t)
+	loc, _ := lookupLocation("london")
+	n := &notification{locKey: "london", location: loc, summary: "It is sunny in London today."}
+
+	for _, tc := range []struct {
+		res       telegramResponse
+		permanent bool
+		gone      bool
+	}{
+		{telegramResponse{ErrorCode: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"}, true, true},
+		{telegramResponse{ErrorCode: http.StatusForbidden, Description: "Forbidden: bot was kicked from the group chat"}, true, true},
+		{telegramResponse{ErrorCode: http.StatusBadRequest, Description: "Bad Request: chat not found"}, true, true},
+		{telegramResponse{ErrorCode: http.StatusBadRequest, Description: "Bad Request: can't parse entities"}, true, false},
+		{telegramResponse{ErrorCode: http.StatusTooManyRequests, Description: "Too Many Requests: retry after 5"}, false, false},
+	} {
+		b := newFakeTelegramAPI(t, state, func(request *http.Request, method string, params []byte) telegramResponse {
+			return tc.res
+		})
+
+		config, _ := json.Marshal(telegramConfig{ChatID: 42})
+		err := b.Notify(context.Background(), &registeredSubscription{Channel: channelTelegram, Config: config}, n)
+		deliveryErr := &deliveryError{}
+		if !errors.As(err, &deliveryErr) {
+			t.Errorf("%v: expected a delivery error, got %v", tc.res.Description, err)
+			continue
+		}
+		if deliveryErr.permanent != tc.permanent || deliveryErr.gone != tc.gone {
+			t.Errorf("%v: got permanent %v and gone %v, expected %v and %v", tc.res.Description, deliveryErr.permanent, deliveryErr.gone, tc.permanent, tc.gone)
+		}
+	}
+}
+
+func TestTelegramPoll(t *testing.T) {
+	state := newTestState(t)
+
+	offsets := make(chan int64, 10)
+	sent := make(chan telegramSentMessage, 10)
+	b := newFakeTelegramAPI(t, state, func(request *http.Request, method string, params []byte) telegramResponse {
+		switch method {
+		case "getUpdates":
+			p := struct {
+				Offset int64 `json:"offset"`
+			}{}
+			json.Unmarshal(params, &p)
+			offsets <- p.Offset
+			if p.Offset == 0 {
+				return telegramResult(t, []map[string]any{
+					{"update_id": 7, "message": map[string]any{"chat": map[string]any{"id": 42}, "text": "/subscribe@sevenam_bot london"}},
+					{"update_id": 8, "message": map[string]any{"chat": map[string]any{"id": 42}, "text": "good morning everyone"}},
+					{"update_id": 9, "message": map[string]any{"chat": map[string]any{"id": 43}, "text": "/help"}},
+				})
+			}
+			// long polling waits until the bot stops
+			<-request.Context().Done()
+			return telegramResult(t, []any{})
+		case "sendMessage":
+			msg := telegramSentMessage{}
+			json.Unmarshal(params, &msg)
+			sent <- msg
+			return telegramResult(t, map[string]any{"message_id": 1})
+		}
+		return telegramResponse{OK: false, ErrorCode: http.StatusNotFound, Description: "Not Found"}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.poll(ctx)
+	}()
+
+	receive := func() telegramSentMessage {
+		t.Helper()
+		select {
+		case msg := <-sent:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("the bot did not reply")
+			return telegramSentMessage{}
+		}
+	}
+
+	if msg := receive(); msg.ChatID != 42 || !strings.HasPrefix(msg.Text, "Subscribed to London.") {
+		t.Errorf("unexpected reply to /subscribe: %+v", msg)
+	}
+	if msg := receive(); msg.ChatID != 43 || msg.Text != telegramHelp {
+		t.Errorf("unexpected reply to /help: %+v", msg)
+	}
+
+	// the updates are confirmed by the next poll
+	for _, want := range []int64{0, 10} {
+		select {
+		case offset := <-offsets:
+			if offset != want {
+				t.Errorf("polled with offset %v, expected %v", offset, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the bot did not poll")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bot did not stop")
+	}
+
+	if len(sent) != 0 {
+		t.Errorf("the bot replied to a message that is not a command: %+v", <-sent)
+	}
+	if reg, err := findTelegramRegistration(state, 42); err != nil || strings.Join(reg.Locations, ",") != "london" {
+		t.Errorf("chat was not subscribed, got %+v, %v", reg, err)
+	}
+}
+
+func TestTelegramSubscribe(t *testing.T) {
+	state := newTestState(t)
+	b := &telegramBot{state: state}
+
+	reply, err := b.subscribe(42, "london")
+	if err != nil || !strings.HasPrefix(reply, "Subscribed to London.") {
+		t.Fatalf("subscribing responded with %q, %v", reply, err)
+	}
+	// locations are also found by their name, ignoring case
+	reply, err = b.subscribe(42, "san francisco")
+	if err != nil || !strings.HasPrefix(reply, "Subscribed to San Francisco.") {
+		t.Fatalf("subscribing by name responded with %q, %v", reply, err)
+	}
+	_, err = b.subscribe(42, "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := findTelegramRegistration(state, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(reg.Locations, ","); got != "london,sf" {
+		t.Errorf("chat is subscribed to %v", got)
+	}
+	if len(state.subscriptions["london"]) != 1 || len(state.subscriptions["sf"]) != 1 {
+		t.Error("registration was not indexed by its locations")
+	}
+
+	reply, err = b.unsubscribe(42, "london")
+	if err != nil || reply != "Unsubscribed from London." {
+		t.Errorf("unsubscribing from a location responded with %q, %v", reply, err)
+	}
+	if len(state.subscriptions["london"]) != 0 || len(state.subscriptions["sf"]) != 1 {
+		t.Error("registration was not removed from the location")
+	}
+
+	reply, err = b.unsubscribe(42, "")
+	if err != nil || !strings.HasPrefix(reply, "Unsubscribed.") {
+		t.Errorf("unsubscribing responded with %q, %v", reply, err)
+	}
+	if _, err := findTelegramRegistration(state, 42); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("registration was not deleted: %v", err)
+	}
+
+	reply, err = b.unsubscribe(42, "")
+	if err != nil || reply != "This chat is not subscribed to any location." {
+		t.Errorf("unsubscribing again responded with %q, %v", reply, err)
+	}
+}
+
+func TestTelegramUnknownLocationReply(t *testing.T) {
+	state := newTestState(t)
+	state.publicURL = "https://7am.example.com"
+	b := &telegramBot{state: state}
+
+	// many locations are not all listed, since a message can be at most 4096 characters long
+	locs := map[string]*location{}
+	for i := range 500 {
+		c := &locationConfig{Key: fmt.Sprintf("a-location-with-a-long-key-%03d", i), Name: fmt.Sprintf("Location %d", i), Timezone: "Europe/London"}
+		loc, err := c.toLocation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs[c.Key] = loc
+	}
+	setConfiguredLocations(locs)
+	t.Cleanup(func() { initLocations("") })
+
+	reply, err := b.subscribe(42, strings.Repeat("atlantis ", 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := utf8.RuneCountInString(reply); n > 4096 {
+		t.Errorf("reply is %v characters long", n)
+	}
+	if !strings.Contains(reply, "a-location-with-a-long-key-000") || strings.Contains(reply, fmt.Sprintf("a-location-with-a-long-key-%03d", maxTelegramListedLocations)) {
+		t.Errorf("reply does not list the first %v locations:\n%v", maxTelegramListedLocations, reply)
+	}
+	if !strings.Contains(reply, fmt.Sprintf("and %d more", 500-maxTelegramListedLocations)) || !strings.Contains(reply, "https://7am.example.com/api/locations") {
+		t.Errorf("reply does not point to the list of all locations:\n%v", reply)
+	}
+
+	if _, err := findTelegramRegistration(state, 42); err == nil {
+		t.Error("chat was subscribed to an unknown location")
+	}
+}
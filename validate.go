@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minSummaryLength = 40
+	maxSummaryLength = 1000
+	// maxSummaryAttempts is how many times a summary is generated before giving up and using the fallback summary
+	maxSummaryAttempts = 3
+)
+
+var markdownPattern = regexp.MustCompile("(?m)^\\s*(#{1,6}\\s|[*-]\\s|\\d+\\.\\s|```|>\\s)|\\*\\*|__|\\[[^\\]]*\\]\\([^)]*\\)")
+
+// generateValidSummary generates a summary for the given input, and validates it before it is published.
+// Invalid summaries are regenerated up to maxSummaryAttempts times,
+// after which a fallback summary built from the forecast is returned instead.
+func generateValidSummary(ctx context.Context, state *state, input summaryInput) (string, error) {
+	stats, hasStats := computeForecastStats(input.timeSeries)
+
+	var err error
+	for attempt := 1; attempt <= maxSummaryAttempts; attempt++ {
+		var summary string
+		summary, err = generateSummary(ctx, state, input)
+		if err != nil {
+			return "", err
+		}
+
+		err = validateSummary(summary, input.location, stats, hasStats)
+		if err == nil {
+			return summary, nil
+		}
+
+		slog.Warn("generated weather summary is invalid", "location", input.locKey, "attempt", attempt, "error", err)
+	}
+
+	if !hasStats {
+		return "", fmt.Errorf("unable to generate a valid summary: %w", err)
+	}
+
+	data := state.prompts.newPromptData(input.locKey, input.location, "")
+	summary, fallbackErr := fallbackSummary(input.location, data.Units, data.Language, stats)
+	if fallbackErr != nil {
+		return "", fmt.Errorf("unable to generate a valid summary: %w, and %w", err, fallbackErr)
+	}
+
+	slog.Warn("using fallback weather summary", "location", input.locKey)
+
+	return summary, nil
+}
+
+// validateSummary checks that summary is plain text of reasonable length about the given location,
+// and that the temperatures it mentions are consistent with the forecast.
+func validateSummary(summary string, loc *location, stats forecastStats, hasStats bool) error {
+	s := strings.TrimSpace(summary)
+
+	if len(s) < minSummaryLength {
+		return fmt.Errorf("summary is too short (%d characters)", len(s))
+	}
+	if len(s) > maxSummaryLength {
+		return fmt.Errorf("summary is too long (%d characters)", len(s))
+	}
+
+	if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") || json.Valid([]byte(s)) {
+		return errors.New("summary is json")
+	}
+	if m := markdownPattern.FindString(s); m != "" {
+		return fmt.Errorf("summary contains markdown: %q", m)
+	}
+
+	lower := strings.ToLower(s)
+	if !mentionsLocation(lower, loc) {
+		return fmt.Errorf("summary does not mention %v", loc.displayName)
+	}
+	// only the locations of the locations file are checked, since locations added from the gazetteer
+	// can have names that are common words, such as "Nice" or "Reading"
+	for _, other := range listConfiguredLocations() {
+		name := strings.ToLower(other.displayName)
+		if other != loc && !strings.Contains(strings.ToLower(loc.displayName), name) && containsWord(lower, name) {
+			return fmt.Errorf("summary mentions %v instead of %v", other.displayName, loc.displayName)
+		}
+	}
+
+	if hasStats {
+		if c := checkTemperatureRange(s, stats); !c.passed {
+			return errors.New(c.detail)
+		}
+	}
+
+	return nil
+}
+
+// mentionsLocation reports whether the lowercased summary mentions the location.
+// Names such as "New York City" are also accepted without the "City" suffix.
+func mentionsLocation(lowerSummary string, loc *location) bool {
+	name := strings.ToLower(loc.displayName)
+	return strings.Contains(lowerSummary, name) || strings.Contains(lowerSummary, strings.TrimSuffix(name, " city"))
+}
+
+// containsWord reports whether s contains word, not directly preceded or followed by a letter or digit.
+func containsWord(s string, word string) bool {
+	if word == "" {
+		return false
+	}
+	for i := 0; i <= len(s)-len(word); {
+		j := strings.Index(s[i:], word)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(s[start:])
+		i = start + size
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// temperatureUnits are the temperature scales that a summary gives temperatures in
+type temperatureUnits struct {
+	celsius    bool
+	fahrenheit bool
+}
+
+// parseTemperatureUnits parses the units prompt variable, such as "celsius and fahrenheit".
+// ok is false if units names neither scale.
+func parseTemperatureUnits(units string) (u temperatureUnits, ok bool) {
+	s := strings.ToLower(units)
+	u.celsius = strings.Contains(s, "celsius") || strings.Contains(s, "°c") || containsWord(s, "metric")
+	u.fahrenheit = strings.Contains(s, "fahrenheit") || strings.Contains(s, "°f") || containsWord(s, "imperial")
+	return u, u.celsius || u.fahrenheit
+}
+
+// formatTemperature formats the temperature c, given in celsius, in units.
+// If both scales are used, fahrenheit follows in parentheses.
+func formatTemperature(c float64, units temperatureUnits) string {
+	switch {
+	case units.celsius && units.fahrenheit:
+		return fmt.Sprintf("%.0f°C (%.0f°F)", c, celsiusToFahrenheit(c))
+	case units.fahrenheit:
+		return fmt.Sprintf("%.0f°F", celsiusToFahrenheit(c))
+	default:
+		return fmt.Sprintf("%.0f°C", c)
+	}
+}
+
+// fallbackSummary builds a plain summary from the forecast, for when a valid summary cannot be generated.
+// It is only written in English, so an error is returned for locations that use another language,
+// or whose units name neither celsius nor fahrenheit.
+func fallbackSummary(loc *location, units string, language string, stats forecastStats) (string, error) {
+	if !containsWord(strings.ToLower(language), "english") {
+		return "", fmt.Errorf("there is no fallback summary in %v", language)
+	}
+	u, ok := parseTemperatureUnits(units)
+	if !ok {
+		return "", fmt.Errorf("there is no fallback summary in %v", units)
+	}
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "In %v, expect temperatures between %v and %v today.",
+		loc.displayName, formatTemperature(stats.minTemp, u), formatTemperature(stats.maxTemp, u))
+
+	switch {
+	case stats.maxPrecipitation >= 0.5 || stats.totalPrecipitation >= 1:
+		amount := fmt.Sprintf("%.1fmm", stats.totalPrecipitation)
+		if !u.celsius {
+			amount = fmt.Sprintf("%.2f inches", stats.totalPrecipitation/25.4)
+		}
+		fmt.Fprintf(&sb, " Around %v of rain is forecast, so bring an umbrella.", amount)
+	case stats.totalPrecipitation > 0:
+		sb.WriteString(" Only light showers are expected.")
+	default:
+		sb.WriteString(" No rain is expected.")
+	}
+
+	return sb.String(), nil
+}
+
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSummary(t *testing.T) {
+	newTestState(t)
+	london, _ := lookupLocation("london")
+	stats := forecastStats{minTemp: 12, maxTemp: 18}
+
+	for _, tc := range []struct {
+		name     string
+		summary  string
+		hasStats bool
+		valid    bool
+	}{
+		{"valid", "Good morning, London! Expect a mild day between 12°C (54°F) and 18°C (64°F), and no rain.", true, true},
+		{"without stats", "Good morning, London! Expect a mild day with sunny spells and no rain at all.", false, true},
+		{"too short", "London: 15°C.", true, false},
+		{"too long", "London is sunny at 15°C. " + strings.Repeat("It stays dry. ", 80), true, false},
+		{"json", `{"summary": "London is sunny at 15°C today, and it stays dry until the evening."}`, true, false},
+		{"bold", "Good morning, **London**! Expect a mild day between 12°C and 18°C, and no rain.", true, false},
+		{"list", "- Good morning, London! Expect a mild day between 12°C and 18°C, and no rain.", true, false},
+		{"link", "Good morning, London! Expect a mild day between 12°C and 18°C, see [the forecast](https://met.no).", true, false},
+		{"location missing", "Good morning! Expect a mild day between 12°C (54°F) and 18°C (64°F), and no rain.", true, false},
+		{"other location", "Good morning, London! Like San Francisco, expect a mild day between 12°C and 18°C.", true, false},
+		{"temperature out of range", "Good morning, London! Expect a hot day between 25°C (77°F) and 31°C (88°F), and no rain.", true, false},
+		{"no temperature", "Good morning, London! Expect a mild day with sunny spells and no rain at all.", true, false},
+	} {
+		err := validateSummary(tc.summary, london, stats, tc.hasStats)
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%v: valid is %v, expected %v (%v)", tc.name, valid, tc.valid, err)
+		}
+	}
+}
+
+func TestContainsWord(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		word string
+		want bool
+	}{
+		{"sunny in nice today", "nice", true},
+		{"nice", "nice", true},
+		{"a nicer day", "nice", false},
+		{"nicer in nice", "nice", true},
+		{"reading, uk", "reading", true},
+		{"spreading showers", "reading", false},
+		{"kraków's weather", "kraków", true},
+		{"krakówek", "kraków", false},
+		{"route 66", "6", false},
+		{"anything", "", false},
+		{"", "nice", false},
+	} {
+		if got := containsWord(tc.s, tc.word); got != tc.want {
+			t.Errorf("containsWord(%q, %q) = %v, expected %v", tc.s, tc.word, got, tc.want)
+		}
+	}
+}
+
+func TestMentionsLocation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		summary string
+		want    bool
+	}{
+		{"London", "good morning, london!", true},
+		{"London", "good morning!", false},
+		{"New York City", "sunny in new york city today", true},
+		{"New York City", "sunny in new york today", true},
+		{"New York City", "sunny in york today", false},
+		{"Kraków", "sunny in kraków today", true},
+	} {
+		loc := &location{displayName: tc.name}
+		if got := mentionsLocation(tc.summary, loc); got != tc.want {
+			t.Errorf("mentionsLocation(%q) of %v = %v, expected %v", tc.summary, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFallbackSummary(t *testing.T) {
+	loc := &location{displayName: "London"}
+	dry := forecastStats{minTemp: 10, maxTemp: 20}
+	wet := forecastStats{minTemp: 10, maxTemp: 20, totalPrecipitation: 12.7, maxPrecipitation: 3}
+
+	for _, tc := range []struct {
+		units    string
+		language string
+		stats    forecastStats
+		want     string
+	}{
+		{"celsius and fahrenheit", "English", dry, "In London, expect temperatures between 10°C (50°F) and 20°C (68°F) today. No rain is expected."},
+		{"celsius", "English", wet, "In London, expect temperatures between 10°C and 20°C today. Around 12.7mm of rain is forecast, so bring an umbrella."},
+		{"fahrenheit", "British English", wet, "In London, expect temperatures between 50°F and 68°F today. Around 0.50 inches of rain is forecast, so bring an umbrella."},
+		{"Metric", "english", dry, "In London, expect temperatures between 10°C and 20°C today. No rain is expected."},
+		{"celsius", "German", dry, ""},
+		{"kelvin", "English", dry, ""},
+	} {
+		got, err := fallbackSummary(loc, tc.units, tc.language, tc.stats)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%v in %v: expected no fallback summary, got %q", tc.units, tc.language, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%v in %v: got %q, %v\nexpected %q", tc.units, tc.language, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+const searchInput = document.getElementById("location-search")
+const searchResults = document.getElementById("location-search-results")
+
+let searchTimeout = null
+let searchController = null
+
+searchInput.addEventListener("input", () => {
+    clearTimeout(searchTimeout)
+    searchTimeout = setTimeout(search, 250)
+})
+
+async function search() {
+    const q = searchInput.value.trim()
+    searchController?.abort()
+    if (q.length < 2) {
+        searchResults.replaceChildren()
+        return
+    }
+
+    searchController = new AbortController()
+    try {
+        const places = await fetch(`/api/locations/search?q=${encodeURIComponent(q)}`, {
+            signal: searchController.signal,
+        }).then(jsonOrThrow)
+        searchResults.replaceChildren(...places.map(placeItem))
+    } catch (e) {
+        if (e.name !== "AbortError") {
+            showSearchError(e.message)
+        }
+    }
+}
+
+function placeItem(place) {
+    const li = document.createElement("li")
+    const a = document.createElement("a")
+    a.innerText = `${place.name}, ${place.countryCode}`
+    if (place.location) {
+        a.href = `/${place.location}`
+    } else {
+        a.href = "#"
+        a.addEventListener("click", (event) => {
+            event.preventDefault()
+            addLocation(place, a)
+        })
+    }
+    li.appendChild(a)
+    return li
+}
+
+async function addLocation(place, link) {
+    link.innerText = `Preparing ${place.name}...`
+    try {
+        // the location is only created once its first summary is ready, which can take a few seconds
+        const loc = await fetch("/api/locations", {
+            method: "POST",
+            body: JSON.stringify({ key: place.key }),
+            headers: {
+                "Content-Type": "application/json",
+            },
+        }).then(jsonOrThrow)
+        window.location.href = `/${loc.key}`
+    } catch (e) {
+        showSearchError(e.message)
+    }
+}
+
+function showSearchError(message) {
+    const li = document.createElement("li")
+    li.innerText = `Error: ${message}`
+    searchResults.replaceChildren(li)
+}
+
+async function jsonOrThrow(res) {
+    if (res.status === 200 || res.status === 201) {
+        return res.json()
+    }
+    // failed api requests respond with {"error": {"code", "message", "details"}}
+    const body = await res.json().catch(() => null)
+    throw new Error(body?.error?.message ?? `server returned status ${res.status}`)
+}
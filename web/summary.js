@@ -1,8 +1,14 @@
 const KEY_SUBSCRIPTION = "subscription"
+// the location that the coordinates of the browser snapped to, see onMyLocationButtonClick
+const KEY_MY_LOCATION = "my-location"
+// the service worker cannot access localStorage, so the registration is also kept in a cache that it can read
+const CACHE_REGISTRATION = "7am-registration"
 
 const canReceiveUpdates = "serviceWorker" in navigator
 const getSummaryButton = document.getElementById("get-summary-btn")
 const loc = getSummaryButton.dataset.loc
+const subscribeText = `Get daily updates at ${getSummaryButton.dataset.deliveryTime}`
+const myLocationButton = document.getElementById("my-location-btn")
 
 async function main() {
     getSummaryButton.style.display = "none"
@@ -13,14 +19,13 @@ async function main() {
 
     const reg = await navigator.serviceWorker.ready
 
-    const existingSubscriptionJson = localStorage.getItem(KEY_SUBSCRIPTION)
-    const existingSubscription = existingSubscriptionJson ? JSON.parse(existingSubscriptionJson) : null
+    const existingSubscription = await loadRegistration()
 
     if (existingSubscription?.locations?.includes(loc) ?? false) {
         getSummaryButton.innerText = "Stop updates"
         reg.active.postMessage(loc)
     } else {
-        getSummaryButton.innerText = "Get daily updates at 7am"
+        getSummaryButton.innerText = subscribeText
     }
 
     getSummaryButton.addEventListener("click", onButtonClick)
@@ -31,8 +36,7 @@ async function onButtonClick() {
     const reg = await navigator.serviceWorker.ready
 
     const pushSub = await reg.pushManager.getSubscription()
-    const existingSubscriptionJson = localStorage.getItem(KEY_SUBSCRIPTION)
-    const registeredSubscription = existingSubscriptionJson ? JSON.parse(existingSubscriptionJson) : null
+    const registeredSubscription = await loadRegistration()
     const currentlyEnabled = (registeredSubscription?.locations?.includes(loc) ?? false) && pushSub !== null
 
     if (currentlyEnabled) {
@@ -41,23 +45,26 @@ async function onButtonClick() {
             1
         )
         if (registeredSubscription.locations.length === 0) {
-            await reg.pushManager.getSubscription().then((sub) => sub?.unsubscribe())
-            await fetch(`/registrations/${registeredSubscription.id}`, { method: "DELETE" })
-            localStorage.removeItem(KEY_SUBSCRIPTION)
+            // the subscription proves ownership of registrations that were made before management tokens
+            await fetch(`/registrations/${registeredSubscription.id}`, {
+                method: "DELETE",
+                headers: registrationHeaders(registeredSubscription),
+                body: JSON.stringify({ subscription: pushSub }),
+            })
+            await pushSub?.unsubscribe()
+            await removeRegistration()
         } else {
             const newReg = await fetch(`/registrations/${registeredSubscription.id}`, {
                 method: "PATCH",
-                headers: {
-                    "Content-Type": "application/json"
-                },
+                headers: registrationHeaders(registeredSubscription),
                 body: JSON.stringify({
                     subscription: pushSub,
                     removeLocations: [loc],
                 })
             }).then(jsonOrThrow)
-            localStorage.setItem(KEY_SUBSCRIPTION, JSON.stringify(newReg))
+            await saveRegistration(newReg, registeredSubscription)
         }
-        getSummaryButton.innerText = "Get daily updates at 7am"
+        getSummaryButton.innerText = subscribeText
     } else {
         getSummaryButton.innerText = "Subscribing"
         getSummaryButton.disabled = true
@@ -76,16 +83,20 @@ async function onButtonClick() {
                 applicationServerKey: publicKey
             })
 
+            // subscribing on the page that "use my location" led to subscribes to "my location",
+            // which moves along when the registration is updated with new coordinates
+            const myLocation = loadMyLocation()
+            const coordinates = myLocation?.key === loc ? myLocation.coordinates : undefined
+
             let newSubscription
             if (registeredSubscription) {
                 newSubscription = await fetch(`/registrations/${registeredSubscription.id}`, {
                     method: "PATCH",
-                    headers: {
-                        "Content-Type": "application/json"
-                    },
+                    headers: registrationHeaders(registeredSubscription),
                     body: JSON.stringify({
                         subscription: pushSub,
                         locations: [loc],
+                        coordinates,
                     })
                 }).then(jsonOrThrow)
             } else {
@@ -96,31 +107,104 @@ async function onButtonClick() {
                     },
                     body: JSON.stringify({
                         subscription: pushSub,
-                        locations: [loc]
+                        locations: [loc],
+                        coordinates,
                     })
                 }).then(jsonOrThrow)
             }
 
-            localStorage.setItem(KEY_SUBSCRIPTION, JSON.stringify(newSubscription))
+            await saveRegistration(newSubscription, registeredSubscription)
 
             getSummaryButton.innerText = "Stop updates"
         } catch (error) {
             console.error(error)
             alert(`Error when trying to subscribe to updates: ${error}`)
-            getSummaryButton.innerText = "Get daily updates at 7am"
+            getSummaryButton.innerText = subscribeText
         } finally {
             getSummaryButton.disabled = false
         }
     }
 }
 
-function jsonOrThrow(res) {
+async function onMyLocationButtonClick() {
+    if (!("geolocation" in navigator)) {
+        alert("Your browser does not support geolocation.")
+        return
+    }
+
+    myLocationButton.innerText = "Locating"
+    myLocationButton.disabled = true
+
+    try {
+        const position = await new Promise((resolve, reject) => {
+            navigator.geolocation.getCurrentPosition(resolve, reject, { maximumAge: 10 * 60 * 1000 })
+        })
+        const coordinates = { lat: position.coords.latitude, lon: position.coords.longitude }
+
+        myLocationButton.innerText = "Finding the nearest summary"
+        const nearest = await fetch("/api/locations/nearest", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json"
+            },
+            body: JSON.stringify(coordinates),
+        }).then(jsonOrThrow)
+
+        localStorage.setItem(KEY_MY_LOCATION, JSON.stringify({ key: nearest.location.key, coordinates }))
+        window.location.href = `/${nearest.location.key}`
+    } catch (error) {
+        console.error(error)
+        alert(`Error when trying to find your location: ${error.message ?? error}`)
+        myLocationButton.innerText = "Use my location"
+        myLocationButton.disabled = false
+    }
+}
+
+function loadMyLocation() {
+    const json = localStorage.getItem(KEY_MY_LOCATION)
+    return json ? JSON.parse(json) : null
+}
+
+async function loadRegistration() {
+    const cached = await caches.open(CACHE_REGISTRATION).then((cache) => cache.match("/registration"))
+    if (cached) {
+        return cached.json()
+    }
+    const json = localStorage.getItem(KEY_SUBSCRIPTION)
+    return json ? JSON.parse(json) : null
+}
+
+async function saveRegistration(registration, previous) {
+    // the management token is only returned when it is issued, so it is carried over from the previous registration
+    const saved = { ...registration, token: registration.token ?? previous?.token }
+    localStorage.setItem(KEY_SUBSCRIPTION, JSON.stringify(saved))
+    await caches.open(CACHE_REGISTRATION).then((cache) => cache.put("/registration", new Response(JSON.stringify(saved))))
+}
+
+async function removeRegistration() {
+    localStorage.removeItem(KEY_SUBSCRIPTION)
+    await caches.delete(CACHE_REGISTRATION)
+}
+
+function registrationHeaders(registration) {
+    const headers = { "Content-Type": "application/json" }
+    if (registration.token) {
+        headers["Authorization"] = `Bearer ${registration.token}`
+    }
+    return headers
+}
+
+async function jsonOrThrow(res) {
     if (res.status === 200) {
         return res.json()
     }
-    throw new Error(`server returned status ${res.status}`)
+    // failed api requests respond with {"error": {"code", "message", "details"}}
+    const body = await res.json().catch(() => null)
+    throw new Error(body?.error?.message ?? `server returned status ${res.status}`)
 }
 
+myLocationButton.addEventListener("click", onMyLocationButtonClick)
+
 if (canReceiveUpdates) {
     main()
 } else {
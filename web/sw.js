@@ -8,16 +8,55 @@ self.addEventListener('activate', function (event) {
 
 self.addEventListener("push", (event) => {
     if (event.data) {
-        const { summary, location } = event.data.json()
+        const { summary, location, advisory } = event.data.json()
         event.waitUntil(
             self.registration.showNotification("7am weather summary", {
                 data: location,
-                body: summary,
+                body: advisory ? `${summary}\n\n${advisory}` : summary,
             })
         )
     }
 })
 
+// the push service may expire or rotate a subscription, in which case the registration is updated with the new subscription
+// using the registration saved by the page.
+self.addEventListener("pushsubscriptionchange", (event) => {
+    event.waitUntil(updateRegistration(event))
+})
+
+async function updateRegistration(event) {
+    const cache = await caches.open("7am-registration")
+    const cached = await cache.match("/registration")
+    if (!cached) {
+        return
+    }
+    const registration = await cached.json()
+
+    const subscription = event.newSubscription ??
+        await self.registration.pushManager.subscribe(event.oldSubscription.options)
+
+    const headers = { "Content-Type": "application/json" }
+    if (registration.token) {
+        headers["Authorization"] = `Bearer ${registration.token}`
+    }
+
+    const res = await fetch(`/registrations/${registration.id}`, {
+        method: "PATCH",
+        headers,
+        body: JSON.stringify({ subscription }),
+    })
+    if (res.status !== 200) {
+        const body = await res.json().catch(() => null)
+        throw new Error(body?.error?.message ?? `server returned status ${res.status}`)
+    }
+
+    const newRegistration = await res.json()
+    await cache.put("/registration", new Response(JSON.stringify({
+        ...newRegistration,
+        token: newRegistration.token ?? registration.token,
+    })))
+}
+
 self.addEventListener("notificationclick", (event) => {
     event.notification.close()
     event.waitUntil(
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	// webhookTimeout is the timeout of a single webhook request
+	webhookTimeout = 10 * time.Second
+	// maxWebhookURLLength is the maximum length of the url of a webhook, or of the server of a push channel
+	maxWebhookURLLength = 2048
+	// maxWebhookSecretLength is the maximum length of the secret of a webhook
+	maxWebhookSecretLength = 256
+)
+
+const (
+	// webhookSignatureHeader is the header of a webhook request that carries the hmac of its timestamp and body
+	webhookSignatureHeader = "X-7am-Signature"
+	// webhookTimestampHeader is the header of a webhook request that carries the unix time at which it was signed.
+	// Receivers should reject requests whose timestamp is more than 5 minutes away from their clock,
+	// so that a captured request can not be replayed later.
+	webhookTimestampHeader = "X-7am-Timestamp"
+)
+
+// errNonPublicAddress is returned when an outbound request is sent to a loopback, private, or otherwise non-public address
+var errNonPublicAddress = errors.New("address is not public")
+
+// webhookConfig is the channel config of a webhook registration
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Secret is the key of the hmac in X-7am-Signature. The request is not signed if it is empty.
+	Secret string `json:"secret,omitempty"`
+	// Format is the format of the payload, which is one of webhookFormats. Empty means webhookFormatJSON.
+	Format string `json:"format,omitempty"`
+}
+
+// webhookPayload is the request body of a webhook delivery
+type webhookPayload struct {
+	Location webhookLocation `json:"location"`
+	// Date is the local date of the location that the summary is for, e.g. 2025-06-01
+	Date     string           `json:"date"`
+	Summary  string           `json:"summary"`
+	Advisory string           `json:"advisory,omitempty"`
+	Forecast *webhookForecast `json:"forecast,omitempty"`
+	// URL is the summary page of the location, which is only included if PUBLIC_URL is set
+	URL string `json:"url,omitempty"`
+}
+
+type webhookLocation struct {
+	Key      string  `json:"key"`
+	Name     string  `json:"name"`
+	Lat      float32 `json:"lat"`
+	Lon      float32 `json:"lon"`
+	Timezone string  `json:"timezone"`
+}
+
+// webhookForecast is the forecast of the day that the summary is based on
+type webhookForecast struct {
+	MinTemperatureC float64 `json:"minTemperatureC"`
+	MaxTemperatureC float64 `json:"maxTemperatureC"`
+	// PrecipitationMm is the total precipitation of the day
+	PrecipitationMm float64 `json:"precipitationMm"`
+	// MaxHourlyPrecipitationMm is the highest precipitation in a single hour
+	MaxHourlyPrecipitationMm float64 `json:"maxHourlyPrecipitationMm"`
+}
+
+// webhookNotifier posts summaries to the urls of webhook registrations
+type webhookNotifier struct {
+	client *http.Client
+	// publicURL is the public url of 7am, which links in payloads point to. empty if it is not configured.
+	publicURL string
+	// allowPrivateNetworks allows webhook urls that point to loopback and private addresses
+	allowPrivateNetworks bool
+}
+
+func newWebhookNotifier(publicURL string, allowPrivateNetworks bool) *webhookNotifier {
+	return &webhookNotifier{
+		client:               newOutboundClient(allowPrivateNetworks),
+		publicURL:            publicURL,
+		allowPrivateNetworks: allowPrivateNetworks,
+	}
+}
+
+// newOutboundClient returns the client of requests to urls of registrations, such as webhook urls.
+// Unless allowPrivateNetworks is set, it refuses to connect to non-public addresses.
+func newOutboundClient(allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivateNetworks {
+		// the address is checked after name resolution, so that a public host name can not resolve to a private address
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || !isPublicAddr(ip) {
+				return errNonPublicAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// a proxy would bypass the address check
+	transport.Proxy = nil
+
+	return &http.Client{
+		Transport: otelhttp.NewTransport(transport),
+		Timeout:   webhookTimeout,
+		// redirects are not followed, since they could point anywhere
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkOutboundURL checks that rawURL is an http or https url that newOutboundClient can send requests to.
+// name is the name of the url in errors.
+func checkOutboundURL(name string, rawURL string, allowPrivateNetworks bool) error {
+	if len(rawURL) > maxWebhookURLLength {
+		return fmt.Errorf("%v must not be longer than %d characters", name, maxWebhookURLLength)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", name, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%v must be an http or https url", name)
+	}
+	if !allowPrivateNetworks {
+		host := strings.ToLower(u.Hostname())
+		if ip, err := netip.ParseAddr(host); (err == nil && !isPublicAddr(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return fmt.Errorf("%v must not point to a non-public address", name)
+		}
+	}
+	return nil
+}
+
+func (w *webhookNotifier) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	c := webhookConfig{}
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook config: %w", err)
+	}
+
+	err = checkOutboundURL("webhook url", c.URL, w.allowPrivateNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Secret) > maxWebhookSecretLength {
+		return nil, fmt.Errorf("webhook secret must not be longer than %d bytes", maxWebhookSecretLength)
+	}
+
+	if c.Format == webhookFormatJSON {
+		c.Format = ""
+	}
+	if c.Format != "" && !slices.Contains(webhookFormats, c.Format) {
+		return nil, fmt.Errorf("webhook format must be one of %v", strings.Join(webhookFormats, ", "))
+	}
+
+	return json.Marshal(&c)
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	config := webhookConfig{}
+	err := json.Unmarshal(reg.Config, &config)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid webhook config: %w", err)}
+	}
+
+	body, err := json.Marshal(formatWebhookPayload(config.Format, w.publicURL, n))
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if config.Secret != "" {
+		// every attempt is signed again, so that a retry is not rejected for being too old
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set(webhookTimestampHeader, timestamp)
+		header.Set(webhookSignatureHeader, signWebhookBody(config.Secret, timestamp, body))
+	}
+
+	status, _, err := postJSON(ctx, w.client, config.URL, header, body)
+	if err != nil {
+		return err
+	}
+	if status >= 200 && status < 300 {
+		return nil
+	}
+
+	// every non-2xx response is retried, since the receiving end may be deployed or misconfigured at the moment
+	return &deliveryError{
+		statusCode: status,
+		err:        errors.New("webhook responded with a non-2xx status"),
+	}
+}
+
+// postJSON posts body to url as json, and returns the status code of the response,
+// along with the start of the response body, which is enough to tell the error responses of push servers apart.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, &deliveryError{permanent: true, err: err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	// the rest of the body is drained so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return resp.StatusCode, respBody, nil
+}
+
+func newWebhookPayload(publicURL string, n *notification) *webhookPayload {
+	p := &webhookPayload{
+		Location: webhookLocation{
+			Key:      n.locKey,
+			Name:     n.location.displayName,
+			Lat:      n.location.lat,
+			Lon:      n.location.lon,
+			Timezone: n.location.ianaName,
+		},
+		Date:     time.Now().In(n.location.tz).Format("2006-01-02"),
+		Summary:  n.summary,
+		Advisory: n.advisory,
+	}
+	if n.forecast != nil {
+		p.Forecast = &webhookForecast{
+			MinTemperatureC:          roundTenth(n.forecast.minTemp),
+			MaxTemperatureC:          roundTenth(n.forecast.maxTemp),
+			PrecipitationMm:          roundTenth(n.forecast.totalPrecipitation),
+			MaxHourlyPrecipitationMm: roundTenth(n.forecast.maxPrecipitation),
+		}
+	}
+	if publicURL != "" {
+		p.URL = publicURL + "/" + n.locKey
+	}
+	return p
+}
+
+// signWebhookBody returns the value of X-7am-Signature for the given X-7am-Timestamp and request body,
+// which is "sha256=" followed by the hex encoded hmac-sha256 of the timestamp, a dot, and the body.
+// The timestamp is signed along with the body, so that it can not be changed to replay an old request.
+func signWebhookBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPublicAddr reports whether ip is a globally routable unicast address.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade nat range, see RFC 6598
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func roundTenth(f float64) float64 {
+	return math.Round(f*10) / 10
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	newTestState(t)
+
+	type signedRequest struct {
+		timestamp string
+		signature string
+		body      []byte
+	}
+	requests := make(chan signedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		requests <- signedRequest{
+			timestamp: request.Header.Get(webhookTimestampHeader),
+			signature: request.Header.Get(webhookSignatureHeader),
+			body:      body,
+		}
+	}))
+	defer server.Close()
+
+	w := newWebhookNotifier("", true)
+	config, _ := json.Marshal(webhookConfig{URL: server.URL, Secret: "secret"})
+	loc, _ := lookupLocation("london")
+	err := w.Notify(context.Background(), &registeredSubscription{ID: uuid.New(), Channel: channelWebhook, Config: config}, &notification{
+		locKey:   "london",
+		location: loc,
+		summary:  "It is sunny in London today.",
+	})
+	if err != nil {
+		t.Fatalf("delivery failed: %v", err)
+	}
+	got := <-requests
+
+	timestamp, err := strconv.ParseInt(got.timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid timestamp %q", got.timestamp)
+	}
+	if d := time.Since(time.Unix(timestamp, 0)); d < -time.Minute || d > time.Minute {
+		t.Errorf("timestamp is %v away from now", d)
+	}
+
+	// the signature is verified the way the readme tells receivers to
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(got.timestamp + "." + string(got.body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got.signature != want {
+		t.Errorf("signature is %v, expected %v", got.signature, want)
+	}
+
+	if signWebhookBody("secret", strconv.FormatInt(timestamp-3600, 10), got.body) == got.signature {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
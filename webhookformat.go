@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// formats of webhook payloads. webhookFormatJSON is the default, which is webhookPayload.
+const (
+	webhookFormatJSON    = "json"
+	webhookFormatSlack   = "slack"
+	webhookFormatDiscord = "discord"
+	webhookFormatMatrix  = "matrix"
+)
+
+var webhookFormats = []string{webhookFormatJSON, webhookFormatSlack, webhookFormatDiscord, webhookFormatMatrix}
+
+// discordEmbedColor is the accent color of discord embeds
+const discordEmbedColor = 0xf5a623
+
+// slackMessage is the payload of a slack incoming webhook, see https://api.slack.com/messaging/webhooks
+type slackMessage struct {
+	// Text is the fallback that is shown in notifications
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string       `json:"type"`
+	Text     *slackText   `json:"text,omitempty"`
+	Elements []*slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// discordMessage is the payload of a discord webhook, see https://discord.com/developers/docs/resources/webhook
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	URL         string         `json:"url,omitempty"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Timestamp   string         `json:"timestamp"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+// matrixNotice is the payload of a matrix-hookshot generic webhook,
+// which is posted to the room as an m.notice message.
+type matrixNotice struct {
+	MsgType string `json:"msgtype"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// formatWebhookPayload renders n in the given webhook format.
+func formatWebhookPayload(format string, publicURL string, n *notification) any {
+	p := newWebhookPayload(publicURL, n)
+	switch format {
+	case webhookFormatSlack:
+		return newSlackMessage(p)
+	case webhookFormatDiscord:
+		return newDiscordMessage(p)
+	case webhookFormatMatrix:
+		return newMatrixNotice(p)
+	default:
+		return p
+	}
+}
+
+func newSlackMessage(p *webhookPayload) *slackMessage {
+	title := fmt.Sprintf("%v, %v", p.Location.Name, formatWebhookDate(p.Date))
+	m := &slackMessage{
+		Text: escapeSlack(fmt.Sprintf("%v: %v", title, p.Summary)),
+		Blocks: []slackBlock{
+			{Type: "header", Text: &slackText{Type: "plain_text", Text: title}},
+			{Type: "section", Text: &slackText{Type: "mrkdwn", Text: escapeSlack(p.Summary)}},
+		},
+	}
+	if p.Advisory != "" {
+		m.Blocks = append(m.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: ":warning: " + escapeSlack(p.Advisory)}})
+	}
+
+	var footer []*slackText
+	if p.Forecast != nil {
+		footer = append(footer, &slackText{Type: "mrkdwn", Text: ":thermometer: " + formatTemperatureRange(p.Forecast)})
+	}
+	if p.URL != "" {
+		footer = append(footer, &slackText{Type: "mrkdwn", Text: fmt.Sprintf("<%v|Open in 7am>", p.URL)})
+	}
+	if len(footer) > 0 {
+		m.Blocks = append(m.Blocks, slackBlock{Type: "context", Elements: footer})
+	}
+
+	return m
+}
+
+func newDiscordMessage(p *webhookPayload) *discordMessage {
+	embed := discordEmbed{
+		Title:       fmt.Sprintf("%v, %v", p.Location.Name, formatWebhookDate(p.Date)),
+		URL:         p.URL,
+		Description: p.Summary,
+		Color:       discordEmbedColor,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if p.Forecast != nil {
+		embed.Fields = append(embed.Fields, discordField{Name: "Temperature", Value: formatTemperatureRange(p.Forecast), Inline: true})
+	}
+	if p.Advisory != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Advisory", Value: p.Advisory})
+	}
+	return &discordMessage{Embeds: []discordEmbed{embed}}
+}
+
+func newMatrixNotice(p *webhookPayload) *matrixNotice {
+	title := fmt.Sprintf("%v, %v", p.Location.Name, formatWebhookDate(p.Date))
+
+	var textBody, htmlBody strings.Builder
+	fmt.Fprintf(&textBody, "%v\n%v", title, p.Summary)
+	fmt.Fprintf(&htmlBody, "<strong>%v</strong><br>%v", html.EscapeString(title), html.EscapeString(p.Summary))
+	if p.Advisory != "" {
+		fmt.Fprintf(&textBody, "\n⚠️ %v", p.Advisory)
+		fmt.Fprintf(&htmlBody, "<br>⚠️ %v", html.EscapeString(p.Advisory))
+	}
+	if p.Forecast != nil {
+		fmt.Fprintf(&textBody, "\n🌡️ %v", formatTemperatureRange(p.Forecast))
+		fmt.Fprintf(&htmlBody, "<br>🌡️ %v", formatTemperatureRange(p.Forecast))
+	}
+	if p.URL != "" {
+		fmt.Fprintf(&textBody, "\n%v", p.URL)
+		fmt.Fprintf(&htmlBody, `<br><a href="%v">Open in 7am</a>`, html.EscapeString(p.URL))
+	}
+
+	return &matrixNotice{MsgType: "m.notice", Text: textBody.String(), HTML: htmlBody.String()}
+}
+
+// formatTemperatureRange formats the temperature range of a forecast in celsius and fahrenheit, e.g. "11°C – 20°C (52°F – 68°F)".
+func formatTemperatureRange(f *webhookForecast) string {
+	return fmt.Sprintf("%.0f°C – %.0f°C (%.0f°F – %.0f°F)",
+		f.MinTemperatureC, f.MaxTemperatureC,
+		celsiusToFahrenheit(f.MinTemperatureC), celsiusToFahrenheit(f.MaxTemperatureC),
+	)
+}
+
+// formatWebhookDate formats a YYYY-MM-DD date for display, e.g. "Sunday, June 1".
+func formatWebhookDate(date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	return t.Format("Monday, January 2")
+}
+
+// escapeSlack escapes the control characters of slack mrkdwn, see https://api.slack.com/reference/surfaces/formatting#escaping
+func escapeSlack(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of webhook formats")
+
+func TestWebhookFormats(t *testing.T) {
+	newTestState(t)
+	loc, _ := lookupLocation("london")
+
+	for _, tc := range []struct {
+		name      string
+		publicURL string
+		n         *notification
+	}{
+		{
+			name:      "full",
+			publicURL: "https://7am.example.com",
+			n: &notification{
+				locKey:   "london",
+				location: loc,
+				summary:  "Good morning, London! Showers <3pm & a cool breeze, so bring an umbrella.",
+				advisory: "Yellow warning for rain & wind",
+				forecast: &forecastStats{minTemp: 8.04, maxTemp: 14.96, totalPrecipitation: 6.25, maxPrecipitation: 2.1},
+			},
+		},
+		{
+			name: "no-public-url",
+			n: &notification{
+				locKey:   "london",
+				location: loc,
+				summary:  "Good morning, London! A dry and mild day.",
+			},
+		},
+	} {
+		p := newWebhookPayload(tc.publicURL, tc.n)
+		// the date is the current date of the location, which would change the golden files every day
+		p.Date = "2026-06-01"
+
+		for _, format := range webhookFormats {
+			var payload any
+			switch format {
+			case webhookFormatSlack:
+				payload = newSlackMessage(p)
+			case webhookFormatDiscord:
+				m := newDiscordMessage(p)
+				m.Embeds[0].Timestamp = "2026-06-01T06:00:00Z"
+				payload = m
+			case webhookFormatMatrix:
+				payload = newMatrixNotice(p)
+			default:
+				payload = p
+			}
+
+			got, err := json.MarshalIndent(payload, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			path := filepath.Join("testdata", "webhook", format+"-"+tc.name+".json")
+			if *updateGolden {
+				err = os.WriteFile(path, got, 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v payload differs from %v:\n%s", format, path, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// webpushNotifier delivers summaries as web push notifications
+type webpushNotifier struct {
+	state *state
+}
+
+func (w *webpushNotifier) ValidateConfig(config json.RawMessage) (json.RawMessage, error) {
+	sub := webpush.Subscription{}
+	err := json.Unmarshal(config, &sub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web push subscription: %w", err)
+	}
+	err = validateSubscription(&sub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&sub)
+}
+
+func (w *webpushNotifier) Notify(ctx context.Context, reg *registeredSubscription, n *notification) error {
+	sub := webpush.Subscription{}
+	err := json.Unmarshal(reg.Config, &sub)
+	if err != nil {
+		return &deliveryError{permanent: true, gone: true, err: fmt.Errorf("invalid web push subscription: %w", err)}
+	}
+
+	b, err := json.Marshal(&webpushNotificationPayload{
+		Summary:  n.summary,
+		Location: n.locKey,
+		Advisory: n.advisory,
+	})
+	if err != nil {
+		return err
+	}
+
+	sendStart := time.Now()
+	resp, err := webpush.SendNotificationWithContext(ctx, b, &sub, webpushOptions(w.state))
+	webpushSendDuration.Observe(time.Since(sendStart).Seconds())
+	if err != nil {
+		webpushSendsTotal.WithLabelValues(pushStatusLabel(0, err)).Inc()
+		return err
+	}
+	resp.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	webpushSendsTotal.WithLabelValues(pushStatusLabel(resp.StatusCode, nil)).Inc()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	return &deliveryError{
+		statusCode: resp.StatusCode,
+		// the push service rejects expired subscriptions with 404 or 410, and malformed pushes with other 4xx codes
+		// except 429, see RFC 8030 section 8.
+		permanent: resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests,
+		gone:      resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone,
+		err:       errors.New("push service rejected web push"),
+	}
+}